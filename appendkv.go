@@ -13,82 +13,174 @@
 //
 //      | 4-byte size | size-byte value |
 //
+// If kv-file is created with `KVChecksum` configured, every entry carries a
+// record-type and CRC32 of size, type and value,
+//
+//      | 4-byte size | 1-byte type | 4-byte crc | size-byte value |
+//
 // Maximum size of each entry is int32, that is 2^31.
 package btree
 
 import (
-	"log"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"reflect"
+	"sync/atomic"
 	"unsafe"
 )
 
+// kv-file entry format, persisted in head sector.
+const (
+	KV_PLAIN    byte = 0 // size and value.
+	KV_CHECKSUM byte = 1 // size, record-type, crc and value.
+)
+
+// record-type of kv-file entries.
+const (
+	KV_KEY byte = iota + 1
+	KV_DOCID
+	KV_VALUE
+)
+
 // Append/Fetch value as either byte-slice or string
 func (store *Store) fetchValue(fpos int64) []byte {
-	return store.WStore.readKV(store.kvRfd, fpos)
+	return store.WStore.readKV(fpos, KV_VALUE)
 }
 
 func (store *Store) fetchValueS(fpos int64) string {
-	return string(store.WStore.readKV(store.kvRfd, fpos))
+	return string(store.WStore.readKV(fpos, KV_VALUE))
 }
 
 func (store *Store) appendValue(val []byte) int64 {
-	return store.WStore.appendKV(val)
+	return store.WStore.appendKV(val, KV_VALUE)
 }
 
 func (store *Store) appendValueS(val string) int64 {
-	return store.WStore.appendKV([]byte(val))
+	return store.WStore.appendKV([]byte(val), KV_VALUE)
 }
 
 // Append/Fetch key as either byte-slice or string
 // support fetch from cached keys
 func (store *Store) fetchKey(fpos int64) []byte {
-	return store.WStore.lookupKey(store.kvRfd, fpos)
+	return store.WStore.lookupKey(fpos)
 }
 
 func (store *Store) appendKey(key []byte) int64 {
-	fpos := store.WStore.appendKV(key)
+	fpos := store.WStore.appendKV(key, KV_KEY)
 	store.WStore.cacheKey(fpos, key)
 	return fpos
 }
 
 // Append/Fetch Docid as either byte-slice or string
 func (store *Store) fetchDocid(fpos int64) []byte {
-	return store.WStore.lookupDocid(store.kvRfd, fpos)
+	return store.WStore.lookupDocid(fpos)
 }
 
 func (store *Store) appendDocid(docid []byte) int64 {
-	fpos := store.WStore.appendKV(docid)
+	fpos := store.WStore.appendKV(docid, KV_DOCID)
 	store.WStore.cacheDocid(fpos, docid)
 	return fpos
 }
 
-// Read bytes from `kvStore.rfd` at `fpos`.
-func (wstore *WStore) readKV(rfd *os.File, fpos int64) []byte {
-	if _, err := rfd.Seek(fpos, os.SEEK_SET); err != nil {
-		log.Panicln(err, fpos)
+// kv-file generation. Compaction copies live entries into a new kv-file,
+// whose entries are numbered beyond the last entry of older kv-file, so that
+// file-positions of older generations are never reused. Entry at
+// file-position `fpos` is at offset `fpos - base` of its kv-file. Readers on
+// older snapshots continue to read from older generations until they are
+// retired.
+type kvGen struct {
+	base int64    // file-position of the first byte of this generation.
+	rfd  *os.File // random read-only access for this generation.
+	prev *kvGen   // older generation, nil once retired.
+}
+
+// Read-only file descriptor and file-offset for entry at `fpos`. Fails with
+// ErrCorrupt if the generation containing `fpos` is already retired.
+func (wstore *WStore) kvRfd(fpos int64) (*os.File, int64) {
+	gen := (*kvGen)(atomic.LoadPointer(&wstore.kvgen))
+	for fpos < gen.base && gen.prev != nil {
+		gen = gen.prev
+	}
+	if fpos < gen.base {
+		panic(fmt.Errorf("%w: kv-file generation for fpos %v is retired",
+			ErrCorrupt, fpos))
 	}
+	return gen.rfd, fpos - gen.base
+}
 
-	buf := make([]byte, 4)
-	rfd.ReadAt(buf, fpos) // Read size field
-	b := make([]byte, bytesToint32(buf))
-	if _, err := rfd.ReadAt(b, fpos+4); err != nil {
-		panic(err)
+// Read bytes from kv-file at `fpos`. For checksummed kv-file, entry must be
+// of record-type `typ` and match its CRC.
+func (wstore *WStore) readKV(fpos int64, typ byte) []byte {
+	rfd, off := wstore.kvRfd(fpos)
+	hdr := make([]byte, wstore.kvHeaderSize())
+	if _, err := rfd.ReadAt(hdr, off); err != nil { // Read size field
+		panic(fmt.Errorf("%w: kv-file size field at fpos %v, %v", ErrCorrupt, fpos, err))
+	}
+	size := bytesToint32(hdr)
+	if size < 0 {
+		panic(fmt.Errorf("%w: kv-file size %v at fpos %v", ErrCorrupt, size, fpos))
+	}
+	b := make([]byte, size)
+	if _, err := rfd.ReadAt(b, off+int64(len(hdr))); err != nil {
+		panic(fmt.Errorf("%w: kv-file entry at fpos %v, %v", ErrCorrupt, fpos, err))
+	}
+	if wstore.head.kvformat == KV_CHECKSUM {
+		if hdr[4] != typ {
+			panic(fmt.Errorf("%w: kv-file record-type %v at fpos %v, expected %v",
+				ErrCorrupt, hdr[4], fpos, typ))
+		}
+		crc := binary.LittleEndian.Uint32(hdr[5:])
+		if crc1 := kvCRC(hdr, b); crc1 != crc {
+			panic(fmt.Errorf("%w: kv-file checksum %x at fpos %v, expected %x",
+				ErrCorrupt, crc1, fpos, crc))
+		}
 	}
 	wstore.countReadKV += 1
 	return b
 }
 
-func (wstore *WStore) appendKV(val []byte) int64 {
+// Append `val` of record-type `typ` to kv-file and return its file-position.
+func (wstore *WStore) appendKV(val []byte, typ byte) int64 {
 	wfd := wstore.kvWfd
-	fpos, _ := wfd.Seek(0, os.SEEK_END)
-	buf := int32Tobytes(int32(len(val)))
-	wfd.WriteAt(buf, fpos)
-	if _, err := wfd.WriteAt(val, fpos+4); err != nil {
+	off, err := wfd.Seek(0, os.SEEK_END)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := wfd.WriteAt(wstore.kvRecord(val, typ), off); err != nil {
 		panic(err)
 	}
 	wstore.countAppendKV += 1
-	return fpos
+	gen := (*kvGen)(atomic.LoadPointer(&wstore.kvgen))
+	return gen.base + off
+}
+
+// Format `val` of record-type `typ` as kv-file entry.
+func (wstore *WStore) kvRecord(val []byte, typ byte) []byte {
+	n := wstore.kvHeaderSize()
+	buf := make([]byte, n+len(val))
+	copy(buf, int32Tobytes(int32(len(val))))
+	copy(buf[n:], val)
+	if wstore.head.kvformat == KV_CHECKSUM {
+		buf[4] = typ
+		binary.LittleEndian.PutUint32(buf[5:], kvCRC(buf[:n], val))
+	}
+	return buf
+}
+
+// Size of entry header in kv-file.
+func (wstore *WStore) kvHeaderSize() int {
+	if wstore.head.kvformat == KV_CHECKSUM {
+		return 9
+	}
+	return 4
+}
+
+// CRC32 of kv-file entry, covering size and record-type from `hdr`.
+func kvCRC(hdr, val []byte) uint32 {
+	crc := crc32.Checksum(hdr[:5], crctab)
+	return crc32.Update(crc, crctab, val)
 }
 
 func bytesToint32(buf []byte) int32 {
@@ -11,7 +11,9 @@ package btree
 
 import (
 	"bytes"
+	"errors"
 	"math/rand"
+	"os"
 	"testing"
 )
 
@@ -29,6 +31,40 @@ func Test_KV(t *testing.T) {
 	}
 }
 
+func Test_KVChecksum(t *testing.T) {
+	conf := testconf1
+	conf.KVChecksum = true
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store := NewStore(conf)
+	defer func() {
+		store.Destroy()
+	}()
+
+	kfpos := store.appendKey([]byte("Hello world"))
+	vfpos := store.appendValue([]byte("some value"))
+	if store.WStore.head.kvformat != KV_CHECKSUM {
+		t.Fatalf("expected checksummed kv-file")
+	} else if string(store.fetchValue(vfpos)) != "some value" {
+		t.Fatalf("unexpected value %q", store.fetchValue(vfpos))
+	}
+	fetchErr := func(fpos int64) (err error) {
+		defer catch(&err)
+		store.fetchValue(fpos)
+		return nil
+	}
+	if err := fetchErr(kfpos); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected record-type mismatch, got %v", err)
+	}
+	// flip a byte in the value.
+	fd, _ := os.OpenFile(conf.Kvfile, os.O_RDWR, 0660)
+	fd.WriteAt([]byte{'S'}, vfpos+9)
+	fd.Close()
+	if err := fetchErr(vfpos); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
 var fposs = make([]int64, 0)
 var maxEntries = 100000
 
@@ -0,0 +1,117 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Atomic write batches. Inserts and removes collected in a batch are applied
+// under a single OpStart(true) / OpEnd() transaction, hence they share the
+// copied nodes and become visible to readers as a single snapshot. Typical
+// usage,
+//
+//      b := &btree.Batch{}
+//      b.Remove(oldkey)
+//      b.Insert(newkey, value)
+//      err := bt.Apply(b)
+package btree
+
+// Batch operations
+const (
+	BATCH_INSERT byte = iota
+	BATCH_UNIQUE
+	BATCH_REMOVE
+)
+
+// Batch of index mutations, zero value is an empty batch ready to use. A
+// batch is not safe for concurrent use.
+type Batch struct {
+	ops []batchOp
+	// Following are updated by Apply()
+	Added    int // number of new entries added to the index.
+	Replaced int // number of entries whose value was replaced.
+	Removed  int // number of entries removed from the index.
+}
+
+type batchOp struct {
+	op    byte
+	key   Key
+	value Value
+}
+
+// Insert {key,docid,value} entry, replacing the value if entry is already
+// present. Refer BTree.Insert().
+func (b *Batch) Insert(key Key, v Value) *Batch {
+	b.ops = append(b.ops, batchOp{op: BATCH_INSERT, key: key, value: v})
+	return b
+}
+
+// Alias of Insert(). Refer BTree.Upsert().
+func (b *Batch) Upsert(key Key, v Value) *Batch {
+	return b.Insert(key, v)
+}
+
+// Insert a new {key,docid,value} entry, if the entry is already present the
+// whole batch fails with ErrDuplicate. Refer BTree.InsertUnique().
+func (b *Batch) InsertUnique(key Key, v Value) *Batch {
+	b.ops = append(b.ops, batchOp{op: BATCH_UNIQUE, key: key, value: v})
+	return b
+}
+
+// Remove entry identified by {key,docid}. Refer BTree.Remove().
+func (b *Batch) Remove(key Key) *Batch {
+	b.ops = append(b.ops, batchOp{op: BATCH_REMOVE, key: key})
+	return b
+}
+
+// Number of operations collected in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset the batch so that it can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+	b.Added, b.Replaced, b.Removed = 0, 0, 0
+}
+
+// Apply operations in the batch, in the order they were added, as a single
+// transaction. If any of the operation fails, none of the mutations are
+// applied and batch counts are left as zero.
+func (bt *BTree) Apply(b *Batch) error {
+	added, replaced, removed := 0, 0, 0
+	err := bt.transaction(func(root Node, mv *MV) Node {
+		var ok bool
+		for _, op := range b.ops {
+			switch op.op {
+			case BATCH_INSERT:
+				root, ok = bt.insertRoot(root, op.key, op.value, INSERT_UPSERT, mv)
+			case BATCH_UNIQUE:
+				root, ok = bt.insertRoot(root, op.key, op.value, INSERT_UNIQUE, mv)
+			case BATCH_REMOVE:
+				if root.getLeafNode().size == 0 {
+					continue
+				}
+				if root, _, _, _, ok = root.remove(bt.store, op.key, mv); ok {
+					bt.store.WStore.logWAL(mv, WAL_REMOVE, op.key, nil)
+					removed += 1
+				}
+				continue
+			}
+			bt.store.WStore.logWAL(mv, WAL_UPSERT, op.key, op.value)
+			if ok {
+				replaced += 1
+			} else {
+				added += 1
+			}
+		}
+		return root
+	})
+	if err != nil {
+		return err
+	}
+	b.Added, b.Replaced, b.Removed = added, replaced, removed
+	return nil
+}
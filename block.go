@@ -11,11 +11,29 @@
 // structure, called btree-node. A btree node can be a lnode (also called leaf
 // node) or it can be a inode. `block` structure is fundamental to both type
 // of nodes.
+//
+// btree blocks are persisted in a fixed little-endian layout,
+//
+//      | leaf | reserved  | size   | crc    | reserved |
+//      | byte | [3]byte   | uint32 | uint32 | uint32   |
+//      | ks [size]int64 | ds [size]int64 | vs [size+1]int64 |
+//      | cs [size+1]int64, only for intermediate blocks |
+//
+// `crc` is CRC32 of the header, excluding the crc field, and the arrays. It
+// is verified every time the block is decoded, so that torn writes and bit
+// rot are reported as ErrCorrupt instead of traversing garbage. On little
+// endian hosts arrays are decoded without copying them. Index files created
+// before the binary layout use "encoding/gob", refer Head.format.
 package btree
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"unsafe"
 )
 
 const (
@@ -27,6 +45,20 @@ const (
 	FALSE          = 0
 )
 
+// block encoding formats, persisted in head sector.
+const (
+	BLOCK_GOB    byte = 0 // encoding/gob, index files from older versions.
+	BLOCK_BINARY byte = 1 // fixed little-endian layout.
+)
+
+const BLK_HEADER_SIZE = 16 // bytes, header for binary layout.
+
+// whether in-memory layout of int64 matches the binary layout.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
 // block structure. every field in this structure has a corresponding field
 // persisted as btree-block.
 type block struct {
@@ -35,6 +67,7 @@ type block struct {
 	ks   []int64 // slice of key position in appendkv file.
 	ds   []int64 // slice of docid position in appendkv file.
 	vs   []int64 // slice of `size+1`.
+	cs   []int64 // slice of `size+1` entry counts, for intermediate blocks.
 }
 
 // check whether `block` is a leaf block, which means `Node` is a `lnode`
@@ -49,10 +82,16 @@ func (b *block) newBlock(length int, max int) *block {
 	b.ks = make([]int64, length, max+1)
 	b.ds = make([]int64, length, max+1)
 	b.vs = make([]int64, length+1, max+2)
+	if b.isLeaf() {
+		b.cs = make([]int64, 0, max+2)
+	} else {
+		b.cs = make([]int64, length+1, max+2)
+	}
 	return b
 }
 
 // Encode in-memory node into binary representation to store them on disk.
+// Entry counts are not persisted in gob encoded blocks, refer gobDecode().
 func (b *block) gobEncode() []byte {
 	buf := new(bytes.Buffer)
 	genc := gob.NewEncoder(buf)
@@ -65,11 +104,120 @@ func (b *block) gobEncode() []byte {
 }
 
 // Decode in-memory node into binary representation to store them on disk.
-func (b *block) gobDecode(bs []byte) {
+// gob encoded blocks don't carry a checksum, only decode errors and
+// inconsistent sizes are detected. Blocks are over-written in place without
+// clearing the older, and possibly longer, encoding, hence data after `vs`
+// is left undecoded and entry counts of intermediate blocks are marked as
+// not known by FetchNode().
+func (b *block) gobDecode(bs []byte) error {
 	gdec := gob.NewDecoder(bytes.NewBuffer(bs))
-	gdec.Decode(&b.leaf)
-	gdec.Decode(&b.size)
-	gdec.Decode(&b.ks)
-	gdec.Decode(&b.ds)
-	gdec.Decode(&b.vs)
+	if err := gdec.Decode(&b.leaf); err != nil {
+		return err
+	} else if err = gdec.Decode(&b.size); err != nil {
+		return err
+	} else if err = gdec.Decode(&b.ks); err != nil {
+		return err
+	} else if err = gdec.Decode(&b.ds); err != nil {
+		return err
+	} else if err = gdec.Decode(&b.vs); err != nil {
+		return err
+	}
+	b.cs = b.cs[:0]
+	if len(b.ks) != b.size || len(b.ds) != b.size || len(b.vs) != b.size+1 {
+		return fmt.Errorf("inconsistent block size %v", b.size)
+	}
+	return nil
+}
+
+// Encode in-memory node into fixed little-endian layout.
+func (b *block) binEncode() []byte {
+	n := BLK_HEADER_SIZE + 8*(len(b.ks)+len(b.ds)+len(b.vs)+len(b.cs))
+	data := make([]byte, n)
+	data[0] = b.leaf
+	binary.LittleEndian.PutUint32(data[4:], uint32(b.size))
+	off := BLK_HEADER_SIZE
+	for _, xs := range [][]int64{b.ks, b.ds, b.vs, b.cs} {
+		for _, x := range xs {
+			binary.LittleEndian.PutUint64(data[off:], uint64(x))
+			off += 8
+		}
+	}
+	binary.LittleEndian.PutUint32(data[8:], blockCRC(data))
+	return data
+}
+
+// Decode fixed little-endian layout into in-memory node. Arrays refer to
+// `data` wherever possible, hence `data` must not be reused by the caller.
+func (b *block) binDecode(data []byte) error {
+	if len(data) < BLK_HEADER_SIZE {
+		return fmt.Errorf("block header truncated to %v bytes", len(data))
+	}
+	b.leaf = data[0]
+	b.size = int(binary.LittleEndian.Uint32(data[4:]))
+	count := 3*b.size + 1
+	if b.leaf == FALSE {
+		count += b.size + 1
+	} else if b.leaf != TRUE {
+		return fmt.Errorf("invalid leaf flag %v", b.leaf)
+	}
+	if count*8 > len(data)-BLK_HEADER_SIZE {
+		return fmt.Errorf("block size %v overflows %v bytes", b.size, len(data))
+	}
+	crc := binary.LittleEndian.Uint32(data[8:])
+	if crc1 := blockCRC(data[:BLK_HEADER_SIZE+count*8]); crc1 != crc {
+		return fmt.Errorf("block checksum %x, expected %x", crc1, crc)
+	}
+	xs := int64s(data[BLK_HEADER_SIZE:], count)
+	n, m := b.size, b.size+1
+	b.ks, xs = xs[:n:n], xs[n:]
+	b.ds, xs = xs[:n:n], xs[n:]
+	b.vs, xs = xs[:m:m], xs[m:]
+	if b.leaf == FALSE {
+		b.cs = xs[:m:m]
+	} else {
+		b.cs = nil
+	}
+	return nil
+}
+
+// CRC32 of an encoded block, skipping the crc field in the header.
+func blockCRC(data []byte) uint32 {
+	crc := crc32.Checksum(data[:8], crctab)
+	return crc32.Update(crc, crctab, data[12:])
+}
+
+// Encode block using `format`.
+func (b *block) encode(format byte) []byte {
+	if format == BLOCK_GOB {
+		return b.gobEncode()
+	}
+	return b.binEncode()
+}
+
+// Decode block using `format`.
+func (b *block) decode(format byte, data []byte) error {
+	switch format {
+	case BLOCK_GOB:
+		return b.gobDecode(data)
+	case BLOCK_BINARY:
+		return b.binDecode(data)
+	}
+	return fmt.Errorf("unknown block format %v", format)
+}
+
+// Interpret first `count` little-endian int64 from `data`. Zero copy on
+// little endian hosts if `data` is aligned.
+func int64s(data []byte, count int) []int64 {
+	if littleEndian && uintptr(unsafe.Pointer(&data[0]))%8 == 0 {
+		var xs []int64
+		xsp := (*reflect.SliceHeader)(unsafe.Pointer(&xs))
+		xsp.Data = uintptr(unsafe.Pointer(&data[0]))
+		xsp.Len, xsp.Cap = count, count
+		return xs
+	}
+	xs := make([]int64, count)
+	for i := range xs {
+		xs[i] = int64(binary.LittleEndian.Uint64(data[i*8:]))
+	}
+	return xs
 }
@@ -10,6 +10,7 @@
 package btree
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -59,3 +60,102 @@ func Benchmark_gobdec(b *testing.B) {
 		kn.gobDecode(bytebuf)
 	}
 }
+
+func Test_BinaryBlock(t *testing.T) {
+	b := (&block{leaf: FALSE}).newBlock(3, 4)
+	b.size = 3
+	b.ks = append(b.ks[:0], 10, 20, 30)
+	b.ds = append(b.ds[:0], 11, 21, 31)
+	b.vs = append(b.vs[:0], 1, 2, 3, -4)
+	b.cs = append(b.cs[:0], 5, 6, 7, 8)
+	data := b.binEncode()
+	if len(data) != BLK_HEADER_SIZE+8*14 {
+		t.Fatalf("unexpected encoded size %v", len(data))
+	}
+	nb := &block{}
+	if err := nb.binDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	if nb.leaf != FALSE || nb.size != 3 ||
+		fmt.Sprint(nb.ks, nb.ds, nb.vs, nb.cs) != fmt.Sprint(b.ks, b.ds, b.vs, b.cs) {
+		t.Fatalf("unexpected decode %+v", nb)
+	}
+	if err := nb.binDecode(data[:len(data)-8]); err == nil {
+		t.Fatalf("expected truncated block to fail")
+	}
+}
+
+func Test_GobBlockLeftover(t *testing.T) {
+	// older, longer, encoding of the block is left behind on disk.
+	data := make([]byte, 4096)
+	old := (&block{leaf: FALSE}).newBlock(6, 8)
+	old.size = 6
+	for i := range old.vs {
+		old.vs[i] = int64(1 << 40)
+	}
+	copy(data, old.gobEncode())
+
+	b := (&block{leaf: FALSE}).newBlock(2, 8)
+	b.size = 2
+	b.ks = append(b.ks[:0], 10, 20)
+	b.ds = append(b.ds[:0], 11, 21)
+	b.vs = append(b.vs[:0], 1, 2, 3)
+	copy(data, b.gobEncode())
+	nb := &block{}
+	if err := nb.gobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	if nb.leaf != FALSE || nb.size != 2 ||
+		fmt.Sprint(nb.ks, nb.ds, nb.vs) != fmt.Sprint(b.ks, b.ds, b.vs) {
+		t.Fatalf("unexpected decode %+v", nb)
+	} else if len(nb.cs) != 0 {
+		t.Fatalf("expected no entry counts, got %v", nb.cs)
+	}
+}
+
+func Benchmark_binenc(b *testing.B) {
+	store := testStore(true)
+	defer func() {
+		store.Destroy()
+	}()
+
+	max := store.maxKeys()
+	kn := (&lnode{}).newNode(store)
+	kn.ks = kn.ks[:0]
+	kn.vs = kn.vs[:0]
+	for i := 0; i < max; i++ {
+		kn.ks = append(kn.ks, int64(i))
+		kn.ds = append(kn.ds, int64(i))
+		kn.vs = append(kn.vs, int64(i))
+	}
+	kn.vs = append(kn.vs, 0)
+	kn.size = max
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kn.binEncode()
+	}
+}
+
+func Benchmark_bindec(b *testing.B) {
+	store := testStore(true)
+	defer func() {
+		store.Destroy()
+	}()
+
+	max := store.maxKeys()
+	kn := (&lnode{}).newNode(store)
+	kn.ks = kn.ks[:0]
+	kn.vs = kn.vs[:0]
+	for i := 0; i < max; i++ {
+		kn.ks = append(kn.ks, int64(i))
+		kn.ds = append(kn.ds, int64(i))
+		kn.vs = append(kn.vs, int64(i))
+	}
+	kn.vs = append(kn.vs, 0)
+	kn.size = max
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bytebuf := kn.binEncode()
+		(&block{}).binDecode(bytebuf)
+	}
+}
@@ -21,7 +21,11 @@ import (
 	"time"
 )
 
-// Sub-structure to `Config` structure.
+// Sub-structure to `Config` structure. Index configuration is persisted in
+// the index-file, when opening an existing index, zero fields are picked
+// from the index-file and non-zero fields must match with it. When creating
+// a new index, zero fields default to SECTOR_SIZE, FLIST_SIZE and
+// BLOCK_SIZE.
 type IndexConfig struct {
 	Sectorsize int64 // head sector-size in bytes.
 	Flistsize  int64 // free-list size in bytes.
@@ -35,6 +39,8 @@ type Config struct {
 	//-- file store
 	Idxfile string
 	Kvfile  string
+	// optional write-ahead log, refer to wal.go.
+	Walfile string
 	IndexConfig
 
 	// maximum number of levels btree can grow, this information is used as a
@@ -57,7 +63,8 @@ type Config struct {
 
 	// all intermediate nodes are cached in memory, there are no upper limit
 	// to that. But number of leaf nodes can be really large and
-	// `MaxLeafCache` limits the number of leaf nodes to be cached.
+	// `MaxLeafCache` limits the number of leaf nodes to be cached, least
+	// recently referenced leaves are evicted using CLOCK, refer lcache.go.
 	MaxLeafCache int
 
 	// MVCC throttle rate in milliseconds
@@ -69,10 +76,29 @@ type Config struct {
 	// enables O_DIRECT flag for indexfile and kvfile.
 	Nocache bool
 
+	// entries in kv-file are stored with their record-type and CRC, which
+	// are validated when they are read back. Applicable only when the index
+	// is created, existing kv-file continues with its own format.
+	KVChecksum bool
+
+	// construct `Key` from key-bytes and docid-bytes, required to replay
+	// write-ahead log when the index is re-opened after a crash. docid is
+	// nil for RemoveAll().
+	WALKey func(key, docid []byte) Key
+
 	// Debug
 	Debug bool
 }
 
+// Inclusion flags for Range() API, tells whether `low` and `high` bounds are
+// part of the range.
+const (
+	RANGE_NONE byte = iota // exclude both `low` and `high`
+	RANGE_LOW              // include `low`
+	RANGE_HIGH             // include `high`
+	RANGE_BOTH             // include both `low` and `high`
+)
+
 // btree instance. Typical usage, where `conf` is Config structure.
 //          bt = btree.NewBTree( btree.NewStore( conf ))
 // any number of BTree instances can be created.
@@ -85,50 +111,148 @@ type BTree struct {
 type Indexer interface {
 	// Insert {key,value} pairs into the index. key type is expected to
 	// implement `Key` interface and value type is expected to implement
-	// `Value` interface. If the key is successfuly inserted it returns true.
+	// `Value` interface. Insert is an upsert, if {key,docid} entry is
+	// already present its value is replaced. Returns true if a new entry is
+	// added to the index, false if the value of an existing entry is
+	// replaced.
 	Insert(Key, Value) bool
 
-	// Count number of key,value pairs in this index.
+	// Same as Insert(), but failures are returned as error instead of
+	// panic. Mutations of a failed insert are discarded.
+	InsertE(Key, Value) (bool, error)
+
+	// Set the value for {key,docid}, replacing the value if the entry is
+	// already present, otherwise a new entry is added. Alias of InsertE(),
+	// for callers that want to be explicit about the insert mode.
+	Upsert(Key, Value) (bool, error)
+
+	// Insert a new {key,docid} entry, fails with ErrDuplicate if the entry
+	// is already present in the index, in which case index is not mutated.
+	InsertUnique(Key, Value) error
+
+	// Count number of key,value pairs in this index. Entry counts are not
+	// persisted in gob encoded index files, Count(), Rank() and Select() on
+	// them walk down the sub-trees, use Migrate() to persist the counts.
 	Count() int64
 
+	// Return number of entries that are less than {key,docid}.
+	Rank(Key) int64
+
+	// Return key-bytes, docid-bytes, and value bytes of the n-th element in
+	// the list, starting from zero. Returns nil if `n` is out of range.
+	Select(int64) ([]byte, []byte, []byte)
+
 	// Return key-bytes, docid-bytes, and value bytes of the first
 	// element in the list.
 	Front() ([]byte, []byte, []byte)
 
+	// Return key-bytes, docid-bytes, and value bytes of the last
+	// element in the list.
+	Back() ([]byte, []byte, []byte)
+
 	// Check whether `key` is present in the index.
 	Contains(Key) bool
 
 	// Check whether `key` and `docid` is present in the index.
 	Equals(Key) bool
 
+	// Return value-bytes of the entry identified by {key,docid}. Returns
+	// false if there is no such entry in the index.
+	Get(Key) ([]byte, bool, error)
+
+	// Nearest neighbour lookups on {key,docid}, return key-bytes, docid-bytes
+	// and value-bytes of,
+	//   Floor, the greatest entry less than or equal to `key`.
+	//   Ceiling, the least entry greater than or equal to `key`.
+	//   Lower, the greatest entry strictly less than `key`.
+	//   Higher, the least entry strictly greater than `key`.
+	// Returns ErrNotFound if there is no such entry.
+	Floor(Key) ([]byte, []byte, []byte, error)
+	Ceiling(Key) ([]byte, []byte, []byte, error)
+	Lower(Key) ([]byte, []byte, []byte, error)
+	Higher(Key) ([]byte, []byte, []byte, error)
+
+	// Return a pull-based cursor on the latest snapshot of the index. Unlike
+	// channel based APIs below, the caller walks the index at its own pace
+	// and must Close() the cursor to release the snapshot.
+	Cursor() *Cursor
+
 	// Return a channel on which the caller can receive key bytes, docid-
-	// bytes and value-bytes for each entry in the index.
+	// bytes and value-bytes for each entry in the index. Channel based APIs
+	// must be drained till the channel is closed, otherwise the goroutine
+	// feeding the channel and its snapshot are held for ever.
 	//      ch := bt.FullSet()
 	//      keybytes := <-ch
 	//      valbytes := <-ch
 	//      docidbytes := <-ch
+	//
+	// Deprecated: use Cursor() and Next(), which can stop early.
 	FullSet() <-chan []byte
 
 	// Return a channel on which the caller can receive key-bytes.
+	//
+	// Deprecated: use Cursor() and Key().
 	KeySet() <-chan []byte
 
 	// Return a channel on which the caller can receive docid-bytes
+	//
+	// Deprecated: use Cursor() and Docid().
 	DocidSet() <-chan []byte
 
 	// Return a channel on which the caller can receive value-bytes
+	//
+	// Deprecated: use Cursor() and Value().
 	ValueSet() <-chan []byte
 
 	// Return a channel that will transmit all values associated with `key`,
 	// make sure the `docid` is set to minimum value to lookup all values
-	// greater that `key` && `docid`
+	// greater that `key` && `docid`. Values are gathered before returning,
+	// hence failures are returned as error and the channel is already
+	// closed, it need not be drained.
 	Lookup(Key) (chan []byte, error)
 
-	// FIXME: Define Range() API.
-	//Range(Key, Key) (chan []byte, error)
+	// Return a channel on which the caller can receive key-bytes, docid-
+	// bytes and value-bytes for each entry between `low` and `high`, in sort
+	// order. `incl` is one of RANGE_NONE, RANGE_LOW, RANGE_HIGH, RANGE_BOTH
+	// and tells whether the bounds are part of the range. A nil bound means
+	// the range is unbounded on that side. Bounds are compared on {key,docid},
+	// set docid to minimum / maximum value to cover all docids of a key.
+	//
+	// Deprecated: use Cursor(), Seek(low) and Next() till `high` is
+	// crossed, which can stop early.
+	Range(Key, Key, byte) <-chan []byte
 
-	// Remove an entry identified by {key,docid}
+	// Remove an entry identified by {key,docid}. Returns true iff the entry
+	// was present and removed.
 	Remove(Key) bool
 
+	// Same as Remove(), but failures are returned as error instead of
+	// panic. Returns ErrEmptyIndex if there are no entries in the index.
+	RemoveE(Key) (bool, error)
+
+	// Remove all entries identified by {key}, irrespective of docid, in a
+	// single transaction. Returns the number of entries removed.
+	RemoveAll(Key) int
+
+	// Same as RemoveAll(), but failures are returned as error instead of
+	// panic.
+	RemoveAllE(Key) (int, error)
+
+	// Apply inserts and removes collected in `Batch` as a single
+	// transaction, either all of them are visible to readers or none.
+	Apply(*Batch) error
+
+	// Error returning variants of the read APIs above. Failures while
+	// reading the index, like ErrCorrupt, are returned instead of panic and
+	// ErrClosed is returned if the underlying store is closed.
+	CountE() (int64, error)
+	RankE(Key) (int64, error)
+	SelectE(int64) ([]byte, []byte, []byte, error)
+	FrontE() ([]byte, []byte, []byte, error)
+	BackE() ([]byte, []byte, []byte, error)
+	ContainsE(Key) (bool, error)
+	EqualsE(Key) (bool, error)
+
 	//-- Meant for debugging.
 	Drain()      // flush the MVCC snapshots into disk.
 	Check()      // check the btree data structure for anamolies.
@@ -202,9 +326,81 @@ func (bt *BTree) Close() {
 	bt.store.Close()
 }
 
-func (bt *BTree) Insert(key Key, v Value) bool {
+// Run `fn` on the latest snapshot of the btree. Failures while reading the
+// snapshot are recovered and returned as error.
+func (bt *BTree) read(fn func(root Node)) (err error) {
+	if bt.store.WStore == nil {
+		return ErrClosed
+	}
+	defer catch(&err)
+	root, mv, timestamp := bt.store.OpStart(false)
+	defer bt.store.OpEnd(false, mv, timestamp)
+	fn(root)
+	return nil
+}
+
+// Run `fn` as a transaction, `fn` shall return the new root. Failures within
+// the transaction are recovered and returned as error, in which case the
+// transaction is aborted and none of its mutations are visible.
+func (bt *BTree) transaction(fn func(root Node, mv *MV) Node) (err error) {
+	if bt.store.WStore == nil {
+		return ErrClosed
+	}
+	defer catch(&err)
 	root, mv, timestamp := bt.store.OpStart(true) // root with transaction
-	spawn, mk, md := root.insert(bt.store, key, v, mv)
+	done := false
+	defer func() {
+		if done == false {
+			bt.store.OpAbort(true, mv, timestamp)
+		}
+	}()
+	root = fn(root, mv)
+	mv.root = root.getLeafNode().fpos
+	bt.store.WStore.flushWAL(mv)
+	done = true
+	bt.store.OpEnd(true, mv, timestamp) // Then this
+	return nil
+}
+
+func (bt *BTree) Insert(key Key, v Value) bool {
+	added, err := bt.InsertE(key, v)
+	if err != nil {
+		panic(err)
+	}
+	return added
+}
+
+func (bt *BTree) InsertE(key Key, v Value) (bool, error) {
+	return bt.insert(key, v, INSERT_UPSERT)
+}
+
+func (bt *BTree) Upsert(key Key, v Value) (bool, error) {
+	return bt.InsertE(key, v)
+}
+
+func (bt *BTree) InsertUnique(key Key, v Value) error {
+	_, err := bt.insert(key, v, INSERT_UNIQUE)
+	return err
+}
+
+func (bt *BTree) insert(key Key, v Value, mode byte) (added bool, err error) {
+	err = bt.transaction(func(root Node, mv *MV) Node {
+		var replaced bool
+		root, replaced = bt.insertRoot(root, key, v, mode, mv)
+		added = !replaced
+		bt.store.WStore.logWAL(mv, WAL_UPSERT, key, v)
+		return root
+	})
+	return added && err == nil, err
+}
+
+// Insert {key,docid,value} under transaction `mv`, growing a new root if
+// `root` splits. Return the new root and whether an existing entry was
+// replaced.
+func (bt *BTree) insertRoot(root Node, key Key, v Value, mode byte, mv *MV) (
+	Node, bool) {
+
+	spawn, mk, md, replaced := root.insert(bt.store, key, v, mode, mv)
 	if spawn != nil { // Root splits
 		in := (&inode{}).newNode(bt.store)
 
@@ -216,42 +412,175 @@ func (bt *BTree) Insert(key Key, v Value) bool {
 		in.vs[1] = spawn.getLeafNode().fpos
 		in.vs = in.vs[:2]
 
+		in.cs[0] = root.count(bt.store)
+		in.cs[1] = spawn.count(bt.store)
+		in.cs = in.cs[:2]
+
 		mv.commits[in.fpos] = in
 		root = in
 	}
-	mv.root = root.getLeafNode().fpos
-	bt.store.OpEnd(true, mv, timestamp) // Then this
-	return true
+	return root, replaced
 }
 
 func (bt *BTree) Count() int64 {
-	root, mv, timestamp := bt.store.OpStart(false)
-	count := root.count(bt.store)
-	bt.store.OpEnd(false, mv, timestamp)
+	count, err := bt.CountE()
+	if err != nil {
+		panic(err)
+	}
 	return count
 }
 
+func (bt *BTree) CountE() (count int64, err error) {
+	err = bt.read(func(root Node) {
+		if count = root.count(bt.store); count < 0 {
+			count = root.(*inode).total(bt.store)
+		}
+	})
+	return count, err
+}
+
+func (bt *BTree) Rank(key Key) int64 {
+	n, err := bt.RankE(key)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func (bt *BTree) RankE(key Key) (n int64, err error) {
+	err = bt.read(func(root Node) {
+		n = root.rank(bt.store, key)
+	})
+	return n, err
+}
+
+func (bt *BTree) Select(n int64) ([]byte, []byte, []byte) {
+	b, c, d, err := bt.SelectE(n)
+	if err != nil {
+		panic(err)
+	}
+	return b, c, d
+}
+
+func (bt *BTree) SelectE(n int64) (b, c, d []byte, err error) {
+	err = bt.read(func(root Node) {
+		b, c, d = root.nth(bt.store, n)
+	})
+	return b, c, d, err
+}
+
 func (bt *BTree) Front() ([]byte, []byte, []byte) {
-	root, mv, timestamp := bt.store.OpStart(false)
-	b, c, d := root.front(bt.store)
-	bt.store.OpEnd(false, mv, timestamp)
+	b, c, d, err := bt.FrontE()
+	if err != nil {
+		panic(err)
+	}
+	return b, c, d
+}
+
+func (bt *BTree) FrontE() (b, c, d []byte, err error) {
+	err = bt.read(func(root Node) {
+		b, c, d = root.front(bt.store)
+	})
+	return b, c, d, err
+}
+
+func (bt *BTree) Back() ([]byte, []byte, []byte) {
+	b, c, d, err := bt.BackE()
+	if err != nil {
+		panic(err)
+	}
 	return b, c, d
 }
 
+func (bt *BTree) BackE() (b, c, d []byte, err error) {
+	err = bt.read(func(root Node) {
+		b, c, d = root.back(bt.store)
+	})
+	return b, c, d, err
+}
+
 func (bt *BTree) Contains(key Key) bool {
-	root, mv, timestamp := bt.store.OpStart(false)
-	st := root.contains(bt.store, key)
-	bt.store.OpEnd(false, mv, timestamp)
+	st, err := bt.ContainsE(key)
+	if err != nil {
+		panic(err)
+	}
 	return st
 }
 
+func (bt *BTree) ContainsE(key Key) (st bool, err error) {
+	err = bt.read(func(root Node) {
+		st = root.contains(bt.store, key)
+	})
+	return st, err
+}
+
 func (bt *BTree) Equals(key Key) bool {
-	root, mv, timestamp := bt.store.OpStart(false)
-	st := root.equals(bt.store, key)
-	bt.store.OpEnd(false, mv, timestamp)
+	st, err := bt.EqualsE(key)
+	if err != nil {
+		panic(err)
+	}
 	return st
 }
 
+func (bt *BTree) EqualsE(key Key) (st bool, err error) {
+	err = bt.read(func(root Node) {
+		st = root.equals(bt.store, key)
+	})
+	return st, err
+}
+
+func (bt *BTree) Get(key Key) (value []byte, ok bool, err error) {
+	err = bt.read(func(root Node) {
+		if vfpos := root.get(bt.store, key); vfpos >= 0 {
+			value, ok = bt.store.fetchValue(vfpos), true
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value, ok, nil
+}
+
+func (bt *BTree) Floor(key Key) ([]byte, []byte, []byte, error) {
+	return bt.nearest(key, true, RANGE_HIGH)
+}
+
+func (bt *BTree) Ceiling(key Key) ([]byte, []byte, []byte, error) {
+	return bt.nearest(key, false, RANGE_LOW)
+}
+
+func (bt *BTree) Lower(key Key) ([]byte, []byte, []byte, error) {
+	return bt.nearest(key, true, RANGE_NONE)
+}
+
+func (bt *BTree) Higher(key Key) ([]byte, []byte, []byte, error) {
+	return bt.nearest(key, false, RANGE_NONE)
+}
+
+// Return the first entry from `key` onwards, descending if `desc` is true,
+// `incl` tells whether `key` itself qualifies. Range scans already cross over
+// to sibling nodes when `key` falls at the edge of a leaf.
+func (bt *BTree) nearest(key Key, desc bool, incl byte) (b, c, d []byte, err error) {
+	err = bt.read(func(root Node) {
+		fun := func(kpos, dpos, vpos int64) bool {
+			b = bt.store.fetchKey(kpos)
+			c = bt.store.fetchDocid(dpos)
+			d = bt.store.fetchValue(vpos)
+			return false
+		}
+		if desc {
+			root.rangeScanDesc(bt.store, nil, key, incl, fun)
+		} else {
+			root.rangeScan(bt.store, key, nil, incl, fun)
+		}
+	})
+	if err == nil && b == nil {
+		err = ErrNotFound
+	}
+	return b, c, d, err
+}
+
+// Deprecated: use Cursor() and Next().
 func (bt *BTree) FullSet() <-chan []byte {
 	c := make(chan []byte)
 	go func() {
@@ -267,6 +596,7 @@ func (bt *BTree) FullSet() <-chan []byte {
 	return c
 }
 
+// Deprecated: use Cursor() and Key().
 func (bt *BTree) KeySet() <-chan []byte {
 	c := make(chan []byte)
 	go func() {
@@ -280,6 +610,7 @@ func (bt *BTree) KeySet() <-chan []byte {
 	return c
 }
 
+// Deprecated: use Cursor() and Docid().
 func (bt *BTree) DocidSet() <-chan []byte {
 	c := make(chan []byte)
 	go func() {
@@ -293,6 +624,7 @@ func (bt *BTree) DocidSet() <-chan []byte {
 	return c
 }
 
+// Deprecated: use Cursor() and Value().
 func (bt *BTree) ValueSet() <-chan []byte {
 	c := make(chan []byte)
 	go func() {
@@ -306,48 +638,127 @@ func (bt *BTree) ValueSet() <-chan []byte {
 	return c
 }
 
-func (bt *BTree) LookupDirty(key Key) chan []byte {
+// Deprecated: use Cursor(), refer Indexer.Range().
+func (bt *BTree) Range(low, high Key, incl byte) <-chan []byte {
 	c := make(chan []byte)
 	go func() {
-		root, _, timestamp := bt.store.OpStartDirty(false) // read from MVCC root node
-		root.lookup(bt.store, key, func(val []byte) {
-			c <- val
+		root, mv, timestamp := bt.store.OpStart(false)
+		root.rangeScan(bt.store, low, high, incl, func(kpos, dpos, vpos int64) bool {
+			c <- bt.store.fetchKey(kpos)
+			c <- bt.store.fetchDocid(dpos)
+			c <- bt.store.fetchValue(vpos)
+			return true
 		})
-		bt.store.OpEnd(false, nil, timestamp)
+		bt.store.OpEnd(false, mv, timestamp)
 		close(c)
 	}()
 	return c
 }
 
-func (bt *BTree) Lookup(key Key) chan []byte {
-	c := make(chan []byte)
-	go func() {
-		root, _, timestamp := bt.store.OpStart(false)
+// Values are gathered before returning, like Lookup(), hence the channel
+// need not be drained.
+func (bt *BTree) LookupDirty(key Key) chan []byte {
+	vals := make([][]byte, 0)
+	root, _, timestamp := bt.store.OpStartDirty(false) // read from MVCC root node
+	func() {
+		defer bt.store.OpEnd(false, nil, timestamp)
 		root.lookup(bt.store, key, func(val []byte) {
-			c <- val
+			vals = append(vals, val)
 		})
-		bt.store.OpEnd(false, nil, timestamp)
-		close(c)
 	}()
+	c := make(chan []byte, len(vals))
+	for _, val := range vals {
+		c <- val
+	}
+	close(c)
 	return c
 }
 
+func (bt *BTree) Lookup(key Key) (chan []byte, error) {
+	vals := make([][]byte, 0)
+	err := bt.read(func(root Node) {
+		root.lookup(bt.store, key, func(val []byte) {
+			vals = append(vals, val)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan []byte, len(vals))
+	for _, val := range vals {
+		c <- val
+	}
+	close(c)
+	return c, nil
+}
+
 func (bt *BTree) Remove(key Key) bool {
-	root, mv, timestamp := bt.store.OpStart(true) // root with transaction
-	if root.getLeafNode().size > 0 {
-		root, _, _, _ = root.remove(bt.store, key, mv)
-	} else {
-		panic("Empty index")
+	removed, err := bt.RemoveE(key)
+	if err != nil {
+		panic(err)
 	}
-	mv.root = root.getLeafNode().fpos
-	bt.store.OpEnd(true, mv, timestamp) // Then this
-	return true                         // FIXME: What is this ??
+	return removed
+}
+
+func (bt *BTree) RemoveE(key Key) (removed bool, err error) {
+	err = bt.transaction(func(root Node, mv *MV) Node {
+		if root.getLeafNode().size == 0 {
+			panic(ErrEmptyIndex)
+		}
+		root, _, _, _, removed = root.remove(bt.store, key, mv)
+		if removed {
+			bt.store.WStore.logWAL(mv, WAL_REMOVE, key, nil)
+		}
+		return root
+	})
+	return removed && err == nil, err
+}
+
+func (bt *BTree) RemoveAll(key Key) int {
+	count, err := bt.RemoveAllE(key)
+	if err != nil {
+		panic(err)
+	}
+	return count
+}
+
+func (bt *BTree) RemoveAllE(key Key) (count int, err error) {
+	err = bt.transaction(func(root Node, mv *MV) Node {
+		if root, count = bt.removeAll(root, key, mv); count > 0 {
+			bt.store.WStore.logWAL(mv, WAL_REMOVEALL, key, nil)
+		}
+		return root
+	})
+	if err != nil {
+		count = 0
+	}
+	return count, err
+}
+
+// Remove all entries for `key` under transaction `mv`. Return the new root
+// and the number of entries removed.
+func (bt *BTree) removeAll(root Node, key Key, mv *MV) (Node, int) {
+	var removed bool
+	count := 0
+	for root.getLeafNode().size > 0 {
+		dfpos := bt.store.firstDocid(root, key, mv)
+		if dfpos < 0 {
+			break
+		}
+		dkey := &docidKey{Key: key, dfpos: dfpos, docid: bt.store.fetchDocid(dfpos)}
+		if root, _, _, _, removed = root.remove(bt.store, dkey, mv); !removed {
+			panic(fmt.Errorf("%w: unable to remove docid at fpos %v", ErrCorrupt, dfpos))
+		}
+		count += 1
+	}
+	return root, count
 }
 
 func (bt *BTree) Drain() {
-	bt.store.WStore.translock <- true
-	bt.store.WStore.commit(nil, 0, true)
-	<-bt.store.WStore.translock
+	wstore := bt.store.WStore
+	wstore.translock <- true
+	wstore.commit(nil, wstore.oldestAccess(), true)
+	<-wstore.translock
 }
 
 func (bt *BTree) Check() {
@@ -407,6 +818,10 @@ func (bt *BTree) Stats(check bool) {
 		"docidHits:    %10v     maxlenNC:  %10v    maxlenLC:      %10v \n",
 		wstore.docidHits, wstore.maxlenNC, wstore.maxlenLC,
 	)
+	fmt.Printf(
+		"lcMisses:     %10v    lcEvicts:   %10v\n",
+		wstore.lcMisses, wstore.lcEvictions(),
+	)
 	fmt.Printf(
 		"commitHits:   %10v    popCounts:  %10v    maxlenAccessQ: %10v\n",
 		wstore.commitHits, wstore.popCounts, wstore.maxlenAccessQ,
@@ -432,8 +847,8 @@ func (bt *BTree) Stats(check bool) {
 		wstore.countReadKV, wstore.countAppendKV, len(currentStales),
 	)
 	fmt.Printf(
-		"garbageBlocks:%10v      freelist: %10v    opCount:       %10v\n",
-		wstore.garbageBlocks, len(wstore.freelist.offsets), wstore.opCounts,
+		"overflowBlks: %10v      freelist: %10v    opCount:       %10v\n",
+		len(wstore.freelist.chain), len(wstore.freelist.offsets), wstore.opCounts,
 	)
 	fmt.Printf(
 		"pingpongCacheChangeCnt:%10v\n",
@@ -0,0 +1,1271 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Populate a btree with `count` sorted keys, "key00000", "key00001" ...
+// where key `i` has docid `i` and value "value<i>".
+func testBTree(count int) *BTree {
+	bt := NewBTree(testStore(true))
+	for i := 0; i < count; i++ {
+		k := &TestKey{K: fmt.Sprintf("key%05d", i), Id: int64(i)}
+		bt.Insert(k, &TestValue{V: fmt.Sprintf("value%v", i)})
+	}
+	bt.Drain()
+	return bt
+}
+
+func testKey(i int) *TestKey {
+	return &TestKey{K: fmt.Sprintf("key%05d", i), Id: int64(i)}
+}
+
+func Test_Range(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	collect := func(low, high Key, incl byte) []string {
+		keys := make([]string, 0)
+		ch := bt.Range(low, high, incl)
+		for k := range ch {
+			<-ch
+			<-ch
+			keys = append(keys, string(k))
+		}
+		return keys
+	}
+	check := func(keys []string, from, till int) {
+		if len(keys) != till-from {
+			t.Fatalf("expected %v entries, got %v", till-from, len(keys))
+		}
+		for i, k := range keys {
+			if k != fmt.Sprintf("key%05d", from+i) {
+				t.Fatalf("expected key%05d, got %v", from+i, k)
+			}
+		}
+	}
+
+	check(collect(testKey(100), testKey(1500), RANGE_BOTH), 100, 1501)
+	check(collect(testKey(100), testKey(1500), RANGE_NONE), 101, 1500)
+	check(collect(testKey(100), testKey(1500), RANGE_LOW), 100, 1500)
+	check(collect(testKey(100), testKey(1500), RANGE_HIGH), 101, 1501)
+	check(collect(nil, testKey(10), RANGE_HIGH), 0, 11)
+	check(collect(testKey(1990), nil, RANGE_LOW), 1990, count)
+	check(collect(nil, nil, RANGE_NONE), 0, count)
+	check(collect(testKey(1500), testKey(100), RANGE_BOTH), 0, 0)
+}
+
+func Test_Cursor(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	cur := bt.Cursor()
+	n := 0
+	for cur.Next() {
+		if string(cur.Key()) != fmt.Sprintf("key%05d", n) {
+			t.Fatalf("expected key%05d, got %v", n, string(cur.Key()))
+		}
+		n++
+	}
+	if n != count {
+		t.Fatalf("expected %v entries, got %v", count, n)
+	}
+	for cur.Prev() {
+		n--
+		if string(cur.Value()) != fmt.Sprintf("value%v", n) {
+			t.Fatalf("expected value%v, got %v", n, string(cur.Value()))
+		}
+	}
+	if n != 0 {
+		t.Fatalf("expected to walk back to first entry, stopped at %v", n)
+	}
+
+	if cur.Seek(testKey(1234)) == false {
+		t.Fatal("expected to seek key01234")
+	} else if string(cur.Docid()) != string(testKey(1234).Docid()) {
+		t.Fatalf("expected docid of key01234, got %v", string(cur.Docid()))
+	}
+	cur.Prev()
+	if string(cur.Key()) != "key01233" {
+		t.Fatalf("expected key01233, got %v", string(cur.Key()))
+	}
+	if cur.Seek(&TestKey{K: "key99999"}) || cur.Key() != nil {
+		t.Fatal("expected seek beyond last entry to fail")
+	}
+
+	cur.Close()
+	cur.Close()
+	if cur.Next() {
+		t.Fatal("expected closed cursor to stop")
+	}
+	if len(bt.store.WStore.accessQ) != 0 {
+		t.Fatalf("expected snapshot to be released %v", bt.store.WStore.accessQ)
+	}
+	// channel is not drained, snapshot is released nevertheless.
+	if ch := bt.LookupDirty(testKey(10)); len(ch) == 0 {
+		t.Fatal("expected values for key00010")
+	} else if len(bt.store.WStore.accessQ) != 0 {
+		t.Fatalf("expected snapshot to be released %v", bt.store.WStore.accessQ)
+	}
+}
+
+func Test_ReverseRange(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	if k, _, v := bt.Back(); string(k) != "key01999" || string(v) != "value1999" {
+		t.Fatalf("unexpected back entry %v %v", string(k), string(v))
+	}
+
+	// walk backwards from `high` till `low` is crossed.
+	collect := func(low, high *TestKey, incl byte) []string {
+		keys := make([]string, 0)
+		cur := bt.Cursor()
+		defer cur.Close()
+		var ok bool
+		if high == nil {
+			ok = cur.Last()
+		} else if ok = cur.SeekLE(high); ok && (incl&RANGE_HIGH) == 0 {
+			if string(cur.Key()) == high.K {
+				ok = cur.Prev()
+			}
+		}
+		for ; ok; ok = cur.Prev() {
+			k := string(cur.Key())
+			if low != nil && (k < low.K || (k == low.K && (incl&RANGE_LOW) == 0)) {
+				break
+			}
+			keys = append(keys, k)
+		}
+		if err := cur.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	check := func(keys []string, from, till int) {
+		if len(keys) != from-till {
+			t.Fatalf("expected %v entries, got %v", from-till, len(keys))
+		}
+		for i, k := range keys {
+			if k != fmt.Sprintf("key%05d", from-i-1) {
+				t.Fatalf("expected key%05d, got %v", from-i-1, k)
+			}
+		}
+	}
+
+	check(collect(testKey(100), testKey(1500), RANGE_BOTH), 1501, 100)
+	check(collect(testKey(100), testKey(1500), RANGE_NONE), 1500, 101)
+	check(collect(testKey(100), testKey(1500), RANGE_LOW), 1500, 100)
+	check(collect(testKey(100), testKey(1500), RANGE_HIGH), 1501, 101)
+	check(collect(nil, testKey(10), RANGE_HIGH), 11, 0)
+	check(collect(nil, nil, RANGE_NONE), count, 0)
+	check(collect(testKey(100), testKey(99), RANGE_BOTH), 0, 0)
+	check(collect(nil, testKey(5000), RANGE_BOTH), count, 0)
+
+	cur := bt.Cursor()
+	defer cur.Close()
+	n := count
+	for cur.Prev() {
+		n--
+		if string(cur.Key()) != fmt.Sprintf("key%05d", n) {
+			t.Fatalf("expected key%05d, got %v", n, string(cur.Key()))
+		}
+	}
+	if n != 0 {
+		t.Fatalf("expected to walk back to first entry, stopped at %v", n)
+	}
+	if cur.Last() == false || string(cur.Key()) != "key01999" {
+		t.Fatalf("expected last entry key01999, got %v", string(cur.Key()))
+	}
+	if cur.SeekLE(&TestKey{K: "key00150a"}) == false || string(cur.Key()) != "key00150" {
+		t.Fatalf("expected key00150, got %v", string(cur.Key()))
+	} else if cur.SeekLE(&TestKey{K: "key"}) || cur.Key() != nil {
+		t.Fatalf("expected no entry, got %v", string(cur.Key()))
+	}
+}
+
+func Test_CountRank(t *testing.T) {
+	count := 3000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	// remove every third entry to exercise merges and rotations.
+	removed := 0
+	for i := 0; i < count; i += 3 {
+		bt.Remove(testKey(i))
+		removed++
+	}
+	bt.Drain()
+	bt.Check()
+	if n := bt.Count(); n != int64(count-removed) {
+		t.Fatalf("expected count %v, got %v", count-removed, n)
+	}
+	for i := 1; i < count; i += 3 {
+		rank := int64(i - (i/3 + 1))
+		if n := bt.Rank(testKey(i)); n != rank {
+			t.Fatalf("expected rank %v for key%05d, got %v", rank, i, n)
+		}
+		if k, _, _ := bt.Select(rank); string(k) != fmt.Sprintf("key%05d", i) {
+			t.Fatalf("expected key%05d at %v, got %v", i, rank, string(k))
+		}
+	}
+	if k, _, _ := bt.Select(int64(count)); k != nil {
+		t.Fatalf("expected nil for out of range select, got %v", string(k))
+	}
+}
+
+func Test_RemoveAll(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	// "key01000" with docids spanning across several leaf nodes.
+	for i := 0; i < 500; i++ {
+		k := &TestKey{K: "key01000", Id: int64(count + i)}
+		bt.Insert(k, &TestValue{V: "dup"})
+	}
+	bt.Drain()
+	if n := bt.RemoveAll(&TestKey{K: "key01000"}); n != 501 {
+		t.Fatalf("expected 501 entries removed, got %v", n)
+	}
+	bt.Drain()
+	bt.Check()
+	if n := bt.Count(); n != int64(count-1) {
+		t.Fatalf("expected count %v, got %v", count-1, n)
+	} else if bt.Contains(&TestKey{K: "key01000"}) {
+		t.Fatal("expected key01000 to be removed")
+	} else if bt.Contains(testKey(999)) == false || bt.Contains(testKey(1001)) == false {
+		t.Fatal("expected neighbours of key01000 to be present")
+	}
+	if n := bt.RemoveAll(&TestKey{K: "key01000"}); n != 0 {
+		t.Fatalf("expected no entries removed, got %v", n)
+	}
+}
+
+// Key with docids ordered numerically, unlike their byte order.
+type numDocidKey struct {
+	TestKey
+}
+
+func (k *numDocidKey) Docid() []byte {
+	return []byte(fmt.Sprintf("%v", k.Id))
+}
+
+func (k *numDocidKey) CompareLess(s *Store, kfp, dfp int64, isD bool) (int, int64, int64) {
+	cmp, _, _ := k.TestKey.CompareLess(s, kfp, dfp, false)
+	if cmp != 0 {
+		return cmp, -1, -1
+	} else if !isD {
+		return cmp, kfp, -1
+	}
+	id, _ := strconv.ParseInt(string(s.fetchDocid(dfp)), 10, 64)
+	if k.Id < id {
+		return -1, kfp, -1
+	} else if k.Id > id {
+		return 1, kfp, -1
+	}
+	return 0, kfp, dfp
+}
+
+func (k *numDocidKey) Equal(otherk []byte, otherd []byte) (bool, bool) {
+	return bytes.Equal(k.Bytes(), otherk), bytes.Equal(k.Docid(), otherd)
+}
+
+func Test_RemoveAllDocidOrder(t *testing.T) {
+	bt := testBTree(0)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	for i := 0; i < 500; i++ {
+		k := &numDocidKey{TestKey{K: fmt.Sprintf("key%05d", i%3), Id: int64(i)}}
+		bt.Insert(k, &TestValue{V: "value"})
+	}
+	bt.Drain()
+	if n, err := bt.RemoveAllE(&numDocidKey{TestKey{K: "key00001"}}); err != nil {
+		t.Fatal(err)
+	} else if n != 167 {
+		t.Fatalf("expected 167 entries removed, got %v", n)
+	}
+	bt.Drain()
+	// Check() expects docids in byte order, hence counted.
+	if n := bt.Count(); n != 333 {
+		t.Fatalf("expected count 333, got %v", n)
+	} else if n, _ := bt.RemoveAllE(&numDocidKey{TestKey{K: "key00002"}}); n != 166 {
+		t.Fatalf("expected 166 entries removed, got %v", n)
+	}
+	bt.Drain()
+	if n := bt.Count(); n != 167 {
+		t.Fatalf("expected count 167, got %v", n)
+	}
+}
+
+func Test_InsertRemoveHit(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	// replace values of existing entries, including separator entries.
+	for i := 0; i < count; i += 2 {
+		if bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("new%v", i)}) {
+			t.Fatalf("expected key%05d to be replaced", i)
+		}
+	}
+	if bt.Insert(testKey(count), &TestValue{V: "value"}) == false {
+		t.Fatalf("expected key%05d to be added", count)
+	}
+	bt.Drain()
+	bt.Check()
+	if n := bt.Count(); n != int64(count+1) {
+		t.Fatalf("expected count %v, got %v", count+1, n)
+	}
+	cur := bt.Cursor()
+	for i := 0; cur.Next(); i++ {
+		value := fmt.Sprintf("value%v", i)
+		if i%2 == 0 && i < count {
+			value = fmt.Sprintf("new%v", i)
+		} else if i == count {
+			value = "value"
+		}
+		if string(cur.Value()) != value {
+			t.Fatalf("expected %v, got %v", value, string(cur.Value()))
+		}
+	}
+	cur.Close()
+
+	if bt.Remove(testKey(5)) == false {
+		t.Fatal("expected key00005 to be removed")
+	} else if bt.Remove(testKey(5)) {
+		t.Fatal("expected key00005 to be missing")
+	} else if bt.Remove(&TestKey{K: "key00006", Id: 7}) {
+		t.Fatal("expected {key00006,7} to be missing")
+	}
+	bt.Drain()
+	bt.Check()
+	if n := bt.Count(); n != int64(count) {
+		t.Fatalf("expected count %v, got %v", count, n)
+	}
+}
+
+func Test_Errors(t *testing.T) {
+	if _, err := OpenStore(Config{Idxfile: "./data/nodir/index.dat"}); err == nil {
+		t.Fatal("expected error opening index in missing directory")
+	}
+
+	bt := NewBTree(testStore(true))
+	if _, err := bt.RemoveE(testKey(0)); !errors.Is(err, ErrEmptyIndex) {
+		t.Fatalf("expected ErrEmptyIndex, got %v", err)
+	} else if _, err := bt.InsertE(testKey(0), &TestValue{V: "value0"}); err != nil {
+		t.Fatalf("unexpected error after aborted transaction: %v", err)
+	}
+	bt.Close()
+	bt.Close()
+	if _, err := bt.CountE(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	// truncate the index-file just after the freelist blocks, root block
+	// is no more available.
+	bt = testBTree(2000)
+	fpos_firstblock := bt.store.WStore.fpos_firstblock
+	bt.Close()
+	if err := os.Truncate(testconf1.Idxfile, fpos_firstblock); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore(testconf1); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+
+	// overwrite the root block, index opens but fails on access.
+	bt = testBTree(2000)
+	root := bt.store.WStore.head.root
+	bt.Close()
+	fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte{0xff}, root)
+	fd.Close()
+	store, err := OpenStore(testconf1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt = NewBTree(store)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	if _, err := bt.CountE(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if _, err := bt.InsertE(testKey(1), &TestValue{V: "value1"}); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if _, err := bt.Lookup(testKey(1)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	cur := bt.Cursor()
+	if cur.Next() || !errors.Is(cur.Err(), ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt from cursor, got %v", cur.Err())
+	}
+	cur.Close()
+	if len(bt.store.WStore.accessQ) != 0 {
+		t.Fatalf("expected snapshots to be released %v", bt.store.WStore.accessQ)
+	}
+}
+
+func Test_Upsert(t *testing.T) {
+	count := 1000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	if added, err := bt.Upsert(testKey(10), &TestValue{V: "upsert"}); err != nil {
+		t.Fatal(err)
+	} else if added {
+		t.Fatal("expected key00010 to be replaced")
+	}
+	if err := bt.InsertUnique(testKey(20), &TestValue{V: "unique"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+	if err := bt.InsertUnique(testKey(count), &TestValue{V: "unique"}); err != nil {
+		t.Fatal(err)
+	}
+	// entry that is also a separator in the root node.
+	root := bt.store.FetchNCache(bt.store.WStore.head.root).(*inode)
+	sep, _ := strconv.Atoi(string(bt.store.fetchKey(root.ks[0]))[3:])
+	if added, err := bt.InsertE(testKey(sep), &TestValue{V: "separator"}); err != nil {
+		t.Fatal(err)
+	} else if added {
+		t.Fatalf("expected separator key%05d to be replaced", sep)
+	} else if err := bt.InsertUnique(testKey(sep), &TestValue{}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate for separator, got %v", err)
+	}
+	bt.Drain()
+	bt.Check()
+	if n := bt.Count(); n != int64(count+1) {
+		t.Fatalf("expected count %v, got %v", count+1, n)
+	}
+	if _, _, v := bt.Select(10); string(v) != "upsert" {
+		t.Fatalf("expected upsert, got %v", string(v))
+	} else if _, _, v := bt.Select(20); string(v) != "value20" {
+		t.Fatalf("expected value20, got %v", string(v))
+	} else if _, _, v := bt.Back(); string(v) != "unique" {
+		t.Fatalf("expected unique, got %v", string(v))
+	}
+}
+
+func Test_Get(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	for i := 0; i < count; i++ {
+		value, ok, err := bt.Get(testKey(i))
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok || string(value) != fmt.Sprintf("value%v", i) {
+			t.Fatalf("expected value%v for key%05d, got %v %v", i, i, ok, string(value))
+		}
+	}
+	if _, ok, _ := bt.Get(&TestKey{K: "key00010", Id: 11}); ok {
+		t.Fatal("expected {key00010,11} to be missing")
+	} else if _, ok, _ := bt.Get(&TestKey{K: "key99999"}); ok {
+		t.Fatal("expected key99999 to be missing")
+	}
+}
+
+func Test_PrefixScan(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	collect := func(prefix string) []string {
+		keys := make([]string, 0)
+		cur := bt.Cursor()
+		defer cur.Close()
+		for ok := cur.SeekPrefix([]byte(prefix)); ok; ok = cur.Next() {
+			keys = append(keys, string(cur.Key()))
+		}
+		if err := cur.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	if keys := collect("key012"); len(keys) != 100 {
+		t.Fatalf("expected 100 entries, got %v", len(keys))
+	} else if keys[0] != "key01200" || keys[99] != "key01299" {
+		t.Fatalf("unexpected entries %v .. %v", keys[0], keys[99])
+	}
+	if keys := collect("key01999"); len(keys) != 1 || keys[0] != "key01999" {
+		t.Fatalf("expected key01999, got %v", keys)
+	}
+	if keys := collect("key1"); len(keys) != 0 {
+		t.Fatalf("expected no entries, got %v", len(keys))
+	}
+	if keys := collect(""); len(keys) != count {
+		t.Fatalf("expected %v entries, got %v", count, len(keys))
+	}
+
+	// walk back and forth across the prefix bound.
+	cur := bt.Cursor()
+	defer cur.Close()
+	cur.SeekPrefix([]byte("key012"))
+	if cur.Prev() {
+		t.Fatalf("expected prefix bound, got %v", string(cur.Key()))
+	} else if cur.Next() == false || string(cur.Key()) != "key01200" {
+		t.Fatalf("expected key01200, got %v", string(cur.Key()))
+	}
+	for cur.Next() {
+	}
+	if cur.Prev() == false || string(cur.Key()) != "key01299" {
+		t.Fatalf("expected key01299, got %v", string(cur.Key()))
+	}
+	// Seek() drops the bound.
+	if cur.Seek(nil) == false || cur.Prev() {
+		t.Fatalf("expected first entry")
+	}
+	n := 0
+	for ; cur.Next(); n++ {
+	}
+	if n != count {
+		t.Fatalf("expected %v entries, got %v", count, n)
+	}
+}
+
+func Test_Nearest(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	check := func(fn func(Key) ([]byte, []byte, []byte, error), key Key, i int) {
+		k, _, v, err := fn(key)
+		if i < 0 || i >= count {
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v %v", string(k), err)
+			}
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if string(k) != fmt.Sprintf("key%05d", i) || string(v) != fmt.Sprintf("value%v", i) {
+			t.Fatalf("expected key%05d, got %v %v", i, string(k), string(v))
+		}
+	}
+
+	// every entry, including the ones at the edges of leaf nodes.
+	for i := 0; i < count; i++ {
+		check(bt.Floor, testKey(i), i)
+		check(bt.Ceiling, testKey(i), i)
+		check(bt.Lower, testKey(i), i-1)
+		check(bt.Higher, testKey(i), i+1)
+	}
+	// keys that are not in the index, docid sorts in between.
+	between := &TestKey{K: "key00100", Id: 50}
+	check(bt.Floor, between, 99)
+	check(bt.Lower, between, 99)
+	check(bt.Ceiling, between, 100)
+	check(bt.Higher, between, 100)
+	check(bt.Floor, &TestKey{K: "a"}, -1)
+	check(bt.Ceiling, &TestKey{K: "z"}, count)
+	check(bt.Floor, &TestKey{K: "z"}, count-1)
+}
+
+func Test_Batch(t *testing.T) {
+	count := 2000
+	bt := testBTree(count)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	// move every entry from "key<i>" to "moved<i>" in a single batch.
+	b := &Batch{}
+	for i := 0; i < count; i++ {
+		b.Remove(testKey(i))
+		b.Insert(&TestKey{K: fmt.Sprintf("moved%05d", i), Id: int64(i)}, &TestValue{V: "moved"})
+	}
+	b.Upsert(&TestKey{K: "moved00000", Id: 0}, &TestValue{V: "upsert"})
+	b.Remove(testKey(0))
+	before := len(bt.store.WStore.mvQ)
+	if err := bt.Apply(b); err != nil {
+		t.Fatal(err)
+	} else if b.Added != count || b.Replaced != 1 || b.Removed != count {
+		t.Fatalf("unexpected counts %v %v %v", b.Added, b.Replaced, b.Removed)
+	} else if after := len(bt.store.WStore.mvQ); after > before+1 {
+		t.Fatalf("expected a single snapshot, got %v", after-before)
+	}
+	bt.Drain()
+	bt.Check()
+	if n := bt.Count(); n != int64(count) {
+		t.Fatalf("expected count %v, got %v", count, n)
+	} else if k, _, v := bt.Front(); string(k) != "moved00000" || string(v) != "upsert" {
+		t.Fatalf("unexpected front %v %v", string(k), string(v))
+	}
+
+	// failing batch is not applied.
+	b.Reset()
+	b.Insert(testKey(1), &TestValue{V: "value1"})
+	b.InsertUnique(&TestKey{K: "moved00001", Id: 1}, &TestValue{V: "dup"})
+	if err := bt.Apply(b); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	} else if bt.Equals(testKey(1)) {
+		t.Fatal("expected failed batch to be discarded")
+	}
+	bt.Drain()
+	bt.Check()
+	if n := bt.Count(); n != int64(count) {
+		t.Fatalf("expected count %v, got %v", count, n)
+	}
+}
+
+func Test_BulkLoad(t *testing.T) {
+	bt := NewBTree(testStore(true))
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	// empty bulk load leaves the index empty, then load 10000 entries.
+	for _, count := range []int{0, 10000} {
+		i := 0
+		n, err := bt.BulkLoad(func() (Key, Value, bool) {
+			if i >= count {
+				return nil, nil, false
+			}
+			i++
+			return testKey(i - 1), &TestValue{V: fmt.Sprintf("value%v", i-1)}, true
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if n != int64(count) {
+			t.Fatalf("expected %v entries loaded, got %v", count, n)
+		}
+		bt.Drain()
+		bt.Check()
+		if c := bt.Count(); c != int64(count) {
+			t.Fatalf("expected count %v, got %v", count, c)
+		}
+		for i := 0; i < count; i += 7 {
+			if k, _, v := bt.Select(int64(i)); string(k) != fmt.Sprintf("key%05d", i) {
+				t.Fatalf("expected key%05d, got %v", i, string(k))
+			} else if string(v) != fmt.Sprintf("value%v", i) {
+				t.Fatalf("expected value%v, got %v", i, string(v))
+			}
+		}
+	}
+
+	// index is usable after bulk load.
+	for i := 0; i < 10000; i += 3 {
+		bt.Remove(testKey(i))
+	}
+	bt.Insert(testKey(20000), &TestValue{V: "value"})
+	bt.Drain()
+	bt.Check()
+	if c := bt.Count(); c != 10000-3334+1 {
+		t.Fatalf("expected count %v, got %v", 10000-3334+1, c)
+	}
+
+	if _, err := bt.NewBuilder(); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("expected ErrNotEmpty, got %v", err)
+	}
+}
+
+func Test_BulkLoadUnsorted(t *testing.T) {
+	bt := NewBTree(testStore(true))
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	b, err := bt.NewBuilder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := b.Add(testKey(i), &TestValue{V: "value"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Add(testKey(10), &TestValue{V: "value"}); !errors.Is(err, ErrUnsorted) {
+		t.Fatalf("expected ErrUnsorted, got %v", err)
+	} else if err := b.Finish(); !errors.Is(err, ErrUnsorted) {
+		t.Fatalf("expected aborted builder, got %v", err)
+	}
+	bt.Drain()
+	bt.Check()
+	if c := bt.Count(); c != 0 {
+		t.Fatalf("expected empty index, got %v", c)
+	}
+	bt.Insert(testKey(1), &TestValue{V: "value"})
+	bt.Drain()
+	if c := bt.Count(); c != 1 {
+		t.Fatalf("expected 1 entry, got %v", c)
+	}
+}
+
+func Test_BulkLoadPanic(t *testing.T) {
+	bt := NewBTree(testStore(true))
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	i := 0
+	next := func() (Key, Value, bool) {
+		if i == 500 {
+			panic("next failed")
+		}
+		i++
+		return testKey(i), &TestValue{V: "value"}, true
+	}
+	func() {
+		defer func() { recover() }()
+		bt.BulkLoad(next)
+	}()
+	// transaction lock is released by the aborted builder.
+	bt.Insert(testKey(1), &TestValue{V: "value"})
+	bt.Drain()
+	if c := bt.Count(); c != 1 {
+		t.Fatalf("expected 1 entry, got %v", c)
+	}
+	bt.Check()
+}
+
+func Test_Migrate(t *testing.T) {
+	// create an index with gob encoded blocks, as older versions did.
+	store := testStore(true)
+	wstore := store.WStore
+	root := store.FetchNode(wstore.head.root)
+	wstore.head.format = BLOCK_GOB
+	wstore.head.maxkeys = calculateMaxKeys_gob(wstore.Blocksize)
+	wstore.flushNode(root)
+	bt := NewBTree(store)
+	for i := 0; i < 2000; i++ {
+		bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("value%v", i)})
+		if i%10 == 0 { // more docids for the same key
+			k := &TestKey{K: fmt.Sprintf("key%05d", i), Id: int64(i + 10000)}
+			bt.Insert(k, &TestValue{V: "dup"})
+		}
+	}
+	bt.Drain()
+	store.Close()
+
+	// gob encoded index is still readable.
+	store = testStore(false)
+	if f := store.WStore.head.format; f != BLOCK_GOB {
+		t.Fatalf("expected gob format, got %v", f)
+	} else if c := NewBTree(store).Count(); c != 2200 {
+		t.Fatalf("expected 2200 entries, got %v", c)
+	}
+	store.Close()
+
+	to := testconf1
+	to.Idxfile, to.Kvfile = "./data/migrate_index.dat", "./data/migrate_kv.dat"
+	os.Remove(to.Idxfile)
+	os.Remove(to.Kvfile)
+	if n, err := Migrate(testconf1, to); err != nil {
+		t.Fatal(err)
+	} else if n != 2200 {
+		t.Fatalf("expected 2200 entries migrated, got %v", n)
+	}
+
+	src, dst := NewBTree(testStore(false)), NewBTree(NewStore(to))
+	defer func() {
+		src.store.Destroy()
+		dst.store.Destroy()
+	}()
+	if f := dst.store.WStore.head.format; f != BLOCK_BINARY {
+		t.Fatalf("expected binary format, got %v", f)
+	}
+	dst.Check()
+	scur, dcur := src.Cursor(), dst.Cursor()
+	defer scur.Close()
+	defer dcur.Close()
+	for scur.Next() {
+		if dcur.Next() == false {
+			t.Fatalf("missing %v in migrated index", string(scur.Key()))
+		} else if string(scur.Key()) != string(dcur.Key()) ||
+			string(scur.Docid()) != string(dcur.Docid()) ||
+			string(scur.Value()) != string(dcur.Value()) {
+			t.Fatalf("expected %v, got %v", string(scur.Key()), string(dcur.Key()))
+		}
+	}
+	if dcur.Next() {
+		t.Fatalf("unexpected %v in migrated index", string(dcur.Key()))
+	}
+}
+
+// Unpack index created by an older version, before versioning and entry
+// counts, with 1000 entries inserted and every third entry removed. Blocks
+// are gob encoded and carry bytes left over from older encodings.
+func legacyConfig(t *testing.T) Config {
+	conf := testconf1
+	conf.Idxfile, conf.Kvfile = "./data/legacy_index.dat", "./data/legacy_kv.dat"
+	for _, file := range []string{conf.Idxfile, conf.Kvfile} {
+		fd, err := os.Open(file + ".gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		fd.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(file, data, 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conf
+}
+
+func Test_MigrateLegacy(t *testing.T) {
+	conf := legacyConfig(t)
+	bt := NewBTree(NewStore(conf))
+	if f := bt.store.WStore.head.format; f != BLOCK_GOB {
+		t.Fatalf("expected gob format, got %v", f)
+	} else if c := bt.Count(); c != 666 {
+		t.Fatalf("expected 666 entries, got %v", c)
+	} else if r := bt.Rank(testKey(500)); r != 333 {
+		t.Fatalf("expected rank 333, got %v", r)
+	}
+	// entry counts are not decoded from gob blocks, nor computed up front.
+	root, mv, timestamp := bt.store.OpStart(false)
+	if root.isLeaf() || root.count(bt.store) >= 0 {
+		t.Fatalf("expected root with unknown counts, got %v", root.count(bt.store))
+	}
+	bt.store.OpEnd(false, mv, timestamp)
+	for i := 0; i < 1000; i++ {
+		v, ok, err := bt.Get(testKey(i))
+		if err != nil {
+			t.Fatal(err)
+		} else if i%3 == 0 && ok {
+			t.Fatalf("unexpected key%05d", i)
+		} else if i%3 != 0 && string(v) != fmt.Sprintf("value%v", i) {
+			t.Fatalf("expected value%v, got %v", i, string(v))
+		}
+	}
+	bt.Check()
+	// legacy index can be updated in place.
+	for i := 0; i < 1000; i += 3 {
+		bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("value%v", i)})
+	}
+	bt.Drain()
+	if c := bt.Count(); c != 1000 {
+		t.Fatalf("expected 1000 entries, got %v", c)
+	} else if k, _, _ := bt.Select(999); string(k) != "key00999" {
+		t.Fatalf("expected key00999, got %v", string(k))
+	} else if r := bt.Rank(testKey(600)); r != 600 {
+		t.Fatalf("expected rank 600, got %v", r)
+	}
+	bt.Check()
+	bt.store.Close()
+
+	to := testconf1
+	to.Idxfile, to.Kvfile = "./data/migrate_index.dat", "./data/migrate_kv.dat"
+	os.Remove(to.Idxfile)
+	os.Remove(to.Kvfile)
+	if n, err := Migrate(conf, to); err != nil {
+		t.Fatal(err)
+	} else if n != 1000 {
+		t.Fatalf("expected 1000 entries migrated, got %v", n)
+	}
+	src, dst := NewBTree(NewStore(conf)), NewBTree(NewStore(to))
+	defer func() {
+		src.store.Destroy()
+		dst.store.Destroy()
+	}()
+	if hd := src.store.WStore.head; hd.magic != HEAD_MAGIC || hd.major != INDEX_MAJOR {
+		t.Fatalf("expected upgraded head, got %x %v.%v", hd.magic, hd.major, hd.minor)
+	} else if f := dst.store.WStore.head.format; f != BLOCK_BINARY {
+		t.Fatalf("expected binary format, got %v", f)
+	}
+	dst.Check()
+	for i := 0; i < 1000; i++ {
+		if v, _, _ := dst.Get(testKey(i)); string(v) != fmt.Sprintf("value%v", i) {
+			t.Fatalf("expected value%v, got %v", i, string(v))
+		}
+	}
+}
+
+func Test_CorruptBlock(t *testing.T) {
+	bt := testBTree(1000)
+	root := bt.store.WStore.head.root
+	bt.store.Close()
+
+	// flip a byte in the root block.
+	fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1)
+	fd.ReadAt(data, root+BLK_HEADER_SIZE+3)
+	data[0] ^= 0xff
+	fd.WriteAt(data, root+BLK_HEADER_SIZE+3)
+	fd.Close()
+
+	bt = NewBTree(testStore(false))
+	defer func() {
+		bt.store.Destroy()
+	}()
+	_, _, err = bt.Get(testKey(10))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	} else if !strings.Contains(err.Error(), fmt.Sprint(root)) {
+		t.Fatalf("expected fpos %v in %q", root, err)
+	}
+	cur := bt.Cursor()
+	defer cur.Close()
+	if cur.Next() || !errors.Is(cur.Err(), ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt from cursor, got %v", cur.Err())
+	}
+}
+
+func Test_CompactKV(t *testing.T) {
+	bt := testBTree(2000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	// generate garbage in kv-file by updating and removing entries.
+	for i := 0; i < 2000; i++ {
+		if i%4 == 0 {
+			bt.Remove(testKey(i))
+		} else {
+			bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("newvalue%v", i)})
+		}
+	}
+	bt.Drain()
+	fi, _ := os.Stat(testconf1.Kvfile)
+	before := fi.Size()
+
+	// reader pinned on the snapshot before compaction.
+	cur := bt.Cursor()
+	defer cur.Close()
+	if cur.Seek(testKey(1)) == false {
+		t.Fatal(cur.Err())
+	}
+	reclaimed, err := bt.CompactKV()
+	if err != nil {
+		t.Fatal(err)
+	} else if reclaimed <= 0 {
+		t.Fatalf("expected kv-file to shrink, reclaimed %v", reclaimed)
+	} else if _, err := bt.CompactKV(); err == nil {
+		t.Fatalf("expected compaction to wait for snapshot flush")
+	}
+	for i := 0; i < 30; i++ { // flush snapshots without forcing
+		bt.Insert(testKey(3000+i), &TestValue{V: "value"})
+	}
+	if bt.store.WStore.kvpending != "" {
+		t.Fatalf("expected compacted kv-file to replace kv-file")
+	}
+	bt.Drain() // older kv-file is not retired while the reader is pinned.
+	for i := 1; i < 2000; i++ {
+		if i%4 == 0 {
+			continue
+		}
+		if string(cur.Key()) != fmt.Sprintf("key%05d", i) {
+			t.Fatalf("expected key%05d, got %v", i, string(cur.Key()))
+		} else if string(cur.Value()) != fmt.Sprintf("newvalue%v", i) {
+			t.Fatalf("expected newvalue%v, got %v", i, string(cur.Value()))
+		}
+		cur.Next()
+	}
+	if err := cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	cur.Close()
+	bt.Drain()
+	bt.Check()
+	func() { // older kv-file is retired.
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("expected ErrCorrupt, got %v", err)
+			}
+		}()
+		bt.store.fetchValue(0)
+	}()
+
+	fi, _ = os.Stat(testconf1.Kvfile)
+	if fi.Size() >= before {
+		t.Fatalf("expected kv-file to shrink from %v, got %v", before, fi.Size())
+	}
+	if files, err := kvCompactFiles(testconf1.Kvfile); err != nil || len(files) > 0 {
+		t.Fatalf("expected compacted kv-file to be renamed, %v %v", files, err)
+	}
+	bt.store.Close()
+	bt = NewBTree(testStore(false))
+	if c := bt.Count(); c != 1500+30 {
+		t.Fatalf("expected %v entries, got %v", 1500+30, c)
+	}
+	for i := 1; i < 2000; i += 7 {
+		v, ok, err := bt.Get(testKey(i))
+		if i%4 == 0 && ok {
+			t.Fatalf("unexpected key%05d", i)
+		} else if i%4 != 0 && string(v) != fmt.Sprintf("newvalue%v", i) {
+			t.Fatalf("expected newvalue%v, got %v %v", i, string(v), err)
+		}
+	}
+}
+
+func Test_RecoverKV(t *testing.T) {
+	bt := testBTree(1000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	for i := 0; i < 1000; i += 2 {
+		bt.Remove(testKey(i))
+	}
+	bt.Drain()
+	if _, err := bt.CompactKV(); err != nil {
+		t.Fatal(err)
+	}
+	base := bt.store.WStore.head.kvbase
+	conf := testconf1
+	conf.Idxfile, conf.Kvfile = "./data/crash_index.dat", "./data/crash_kv.dat"
+	copyFile := func(from, to string) {
+		data, err := ioutil.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(to, data, 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crash := func(kvfile, compactfile string) *BTree {
+		copyFile(testconf1.Idxfile, conf.Idxfile)
+		copyFile(kvfile, conf.Kvfile)
+		copyFile(compactfile, kvCompactFile(conf.Kvfile, base))
+		crashbt := NewBTree(NewStore(conf))
+		if files, _ := kvCompactFiles(conf.Kvfile); len(files) > 0 {
+			t.Fatalf("expected compacted kv-file to be recovered, %v", files)
+		} else if c := crashbt.Count(); c != 500 {
+			t.Fatalf("expected %v entries, got %v", 500, c)
+		}
+		for i := 1; i < 1000; i += 2 {
+			v, ok, err := crashbt.Get(testKey(i))
+			if !ok || string(v) != fmt.Sprintf("value%v", i) {
+				t.Fatalf("expected value%v, got %v %v", i, string(v), err)
+			}
+		}
+		return crashbt
+	}
+
+	// crash before the head refers to compacted kv-file, which is discarded.
+	pending := bt.store.WStore.kvpending
+	crashbt := crash(testconf1.Kvfile, pending)
+	if crashbt.store.WStore.head.kvbase == base {
+		t.Fatalf("expected older kv-file")
+	}
+	crashbt.store.Destroy()
+
+	// crash after the head refers to compacted kv-file, but before it is
+	// renamed.
+	oldkv := "./data/crash_oldkv.dat"
+	copyFile(testconf1.Kvfile, oldkv)
+	defer os.Remove(oldkv)
+	bt.Drain()
+	crashbt = crash(oldkv, testconf1.Kvfile)
+	defer func() {
+		crashbt.store.Destroy()
+	}()
+	fi, _ := os.Stat(testconf1.Kvfile)
+	if crashbt.store.WStore.head.kvbase != base {
+		t.Fatalf("expected kvbase %v, got %v", base, crashbt.store.WStore.head.kvbase)
+	} else if crashfi, _ := os.Stat(conf.Kvfile); crashfi.Size() != fi.Size() {
+		t.Fatalf("expected compacted kv-file of %v, got %v", fi.Size(), crashfi.Size())
+	}
+	crashbt.Insert(testKey(2000), &TestValue{V: "value"})
+	crashbt.Check()
+}
+
+func Test_Compact(t *testing.T) {
+	bt := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	for i := 0; i < 5000; i++ {
+		if i%10 != 0 {
+			bt.Remove(testKey(i))
+		}
+	}
+	bt.Drain()
+	fi, _ := os.Stat(testconf1.Idxfile)
+	before := fi.Size()
+	wstore := bt.store.WStore
+	nfree := int64(len(wstore.freelist.offsets) - 1)
+	cutoff := before - nfree*wstore.Blocksize
+	maxLive := func() (max int64) {
+		root := bt.store.FetchNCache(wstore.head.root)
+		for _, fpos := range root.listOffsets(bt.store) {
+			if fpos > max {
+				max = fpos
+			}
+		}
+		return max
+	}
+	if m := maxLive(); m < cutoff {
+		t.Fatalf("expected live blocks beyond cutoff %v, got %v", cutoff, m)
+	}
+
+	n, err := bt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	} else if n <= 0 {
+		t.Fatalf("expected index-file to be truncated")
+	}
+	if m := maxLive(); m >= cutoff {
+		t.Fatalf("expected live blocks below cutoff %v, got %v", cutoff, m)
+	}
+	fi, _ = os.Stat(testconf1.Idxfile)
+	if fi.Size() != before-n {
+		t.Fatalf("expected size %v, got %v", before-n, fi.Size())
+	} else if m := maxLive(); m >= fi.Size() {
+		t.Fatalf("expected live blocks within %v, got %v", fi.Size(), m)
+	}
+	bt.Check()
+	for i := 0; i < 100; i++ { // index is usable after truncation.
+		bt.Insert(testKey(10000+i), &TestValue{V: "value"})
+	}
+	bt.store.Close()
+
+	bt = NewBTree(testStore(false))
+	if c := bt.Count(); c != 500+100 {
+		t.Fatalf("expected %v entries, got %v", 500+100, c)
+	}
+	bt.Check()
+	for i := 0; i < 5000; i += 10 {
+		if v, ok, err := bt.Get(testKey(i)); !ok || string(v) != fmt.Sprintf("value%v", i) {
+			t.Fatalf("expected value%v, got %v %v", i, string(v), err)
+		}
+	}
+}
+
+func Test_CompactReader(t *testing.T) {
+	bt := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	for i := 0; i < 5000; i++ {
+		if i%10 != 0 {
+			bt.Remove(testKey(i))
+		}
+	}
+	bt.Drain()
+
+	// reader pinned on the snapshot before compaction.
+	cur := bt.Cursor()
+	defer cur.Close()
+	if cur.Seek(nil) == false {
+		t.Fatal(cur.Err())
+	}
+	if _, err := bt.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for ok := true; ok; ok = cur.Next() {
+		if string(cur.Key()) != fmt.Sprintf("key%05d", n*10) {
+			t.Fatalf("expected key%05d, got %v", n*10, string(cur.Key()))
+		}
+		n++
+	}
+	if err := cur.Err(); err != nil {
+		t.Fatal(err)
+	} else if n != 500 {
+		t.Fatalf("expected %v entries, got %v", 500, n)
+	}
+	cur.Close()
+
+	// blocks vacated by relocation are truncated once the reader is done.
+	if n, err := bt.Vacuum(); err != nil || n <= 0 {
+		t.Fatalf("expected index-file to be truncated, %v %v", n, err)
+	}
+	bt.Check()
+}
+
+func Test_RebuildFreelist(t *testing.T) {
+	bt := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	for i := 0; i < 5000; i++ {
+		if i%10 != 0 {
+			bt.Remove(testKey(i))
+		}
+	}
+	bt.Drain()
+
+	// crash after the index-file is truncated but before the trimmed
+	// freelist is on disk, by copying files of the live index before
+	// vacuum and truncating the copy. Freelist refers to truncated blocks.
+	conf := testconf1
+	conf.Idxfile, conf.Kvfile = "./data/crash_index.dat", "./data/crash_kv.dat"
+	for _, file := range [][2]string{
+		{testconf1.Idxfile, conf.Idxfile}, {testconf1.Kvfile, conf.Kvfile},
+	} {
+		data, err := ioutil.ReadFile(file[0])
+		if err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(file[1], data, 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := bt.Vacuum(); err != nil || n <= 0 {
+		t.Fatalf("expected index-file to be truncated, %v %v", n, err)
+	}
+	if bt.store.check() == false { // trimmed freelist is flushed by vacuum.
+		t.Fatalf("expected freelist to be consistent after vacuum")
+	}
+	fi, _ := os.Stat(testconf1.Idxfile)
+	if err := os.Truncate(conf.Idxfile, fi.Size()); err != nil {
+		t.Fatal(err)
+	}
+	crashbt := NewBTree(NewStore(conf))
+	defer func() {
+		crashbt.store.Destroy()
+	}()
+	if crashbt.store.check() == false {
+		t.Fatalf("expected freelist to be rebuilt")
+	} else if c := crashbt.Count(); c != 500 {
+		t.Fatalf("expected %v entries, got %v", 500, c)
+	}
+	for i := 0; i < 100; i++ {
+		crashbt.Insert(testKey(10000+i), &TestValue{V: "value"})
+	}
+	crashbt.Check()
+}
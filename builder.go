@@ -0,0 +1,302 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Bulk load an empty index from entries that are already sorted on
+// {key,docid}. Instead of inserting entries one by one, the builder fills
+// leaf nodes left to right, builds intermediate nodes bottom up and writes
+// them into blocks appended to the index file. Only the right most nodes of
+// each level are held in memory. Once finished, the new root is committed as
+// a single MVCC snapshot.
+//
+// Nodes are packed to `maxKeys`, except for the last two nodes of each level
+// which are evenly balanced if the last node falls below `RebalanceThrs`.
+//
+//      b, err := bt.NewBuilder()
+//      for ... {
+//          b.Add(key, value)
+//      }
+//      err = b.Finish()
+package btree
+
+// Builder holds the write transaction from NewBuilder() till Finish() or
+// Abort(), other mutations on the index are blocked meanwhile.
+type Builder struct {
+	store     *Store
+	mv        *MV
+	timestamp int64
+	levels    []buildLevel // levels[0] is leaf level.
+	offsets   []int64      // appended blocks, yet to be used.
+	allocated []int64      // blocks used by the builder.
+	kfpos     int64        // key position of last entry.
+	dfpos     int64        // docid position of last entry.
+	count     int64
+	done      bool
+	err       error
+}
+
+// right most nodes of a btree level, `prev` is full and waiting for `cur` to
+// find out whether they need to be balanced.
+type buildLevel struct {
+	prev, cur    Node
+	prevk, prevd int64 // first entry of `prev` sub-tree.
+	curk, curd   int64 // first entry of `cur` sub-tree.
+}
+
+// Create a builder to bulk load this btree, returns ErrNotEmpty if the index
+// already has entries.
+func (bt *BTree) NewBuilder() (b *Builder, err error) {
+	if bt.store.WStore == nil {
+		return nil, ErrClosed
+	}
+	defer catch(&err)
+	root, mv, timestamp := bt.store.OpStart(true)
+	if root.getLeafNode().size > 0 {
+		bt.store.OpAbort(true, mv, timestamp)
+		return nil, ErrNotEmpty
+	}
+	b = &Builder{
+		store:     bt.store,
+		mv:        mv,
+		timestamp: timestamp,
+		kfpos:     -1,
+		dfpos:     -1,
+	}
+	// root copied by OpStart() is replaced by the new tree.
+	mv.stale(root.getLeafNode().fpos)
+	b.levels = []buildLevel{{cur: b.newLeaf()}}
+	return b, nil
+}
+
+// Bulk load this btree with entries returned by `next`, until it returns
+// false. Entries must be in ascending sort order on {key,docid}. Returns the
+// number of entries loaded.
+func (bt *BTree) BulkLoad(next func() (Key, Value, bool)) (int64, error) {
+	b, err := bt.NewBuilder()
+	if err != nil {
+		return 0, err
+	}
+	// release transaction lock even if `next` panics, no-op after Finish().
+	defer b.Abort()
+	for key, v, ok := next(); ok; key, v, ok = next() {
+		if err = b.Add(key, v); err != nil {
+			return 0, err
+		}
+	}
+	if err = b.Finish(); err != nil {
+		return 0, err
+	}
+	return b.count, nil
+}
+
+// Add next entry, which must be greater than the previously added entry,
+// otherwise ErrUnsorted is returned. On failure the builder is aborted.
+func (b *Builder) Add(key Key, v Value) (err error) {
+	if b.done {
+		return b.closedErr()
+	}
+	defer b.catch(&err)
+	kfpos, dfpos := int64(-1), int64(-1)
+	if b.kfpos >= 0 {
+		var cmp int
+		cmp, kfpos, dfpos = key.CompareLess(b.store, b.kfpos, b.dfpos, true)
+		if cmp <= 0 {
+			panic(ErrUnsorted)
+		}
+	}
+	kfpos, dfpos = b.store.keyOf(key, kfpos, dfpos)
+	b.add(kfpos, dfpos, b.store.valueOf(v))
+	return nil
+}
+
+// Add next entry whose key, docid and value are already appended to kv-file.
+func (b *Builder) add(kfpos, dfpos, vfpos int64) {
+	lv := &b.levels[0]
+	ln := lv.cur.(*lnode)
+	if ln.size == b.store.maxKeys() {
+		b.shift(0, b.newLeaf(), kfpos, dfpos)
+		lv = &b.levels[0] // levels could have grown.
+		ln = lv.cur.(*lnode)
+	}
+	if ln.size == 0 {
+		lv.curk, lv.curd = kfpos, dfpos
+	}
+	ln.ks = append(ln.ks, kfpos)
+	ln.ds = append(ln.ds, dfpos)
+	ln.vs[ln.size] = vfpos
+	ln.vs = append(ln.vs, 0)
+	ln.size = len(ln.ks)
+
+	b.kfpos, b.dfpos = kfpos, dfpos
+	b.count += 1
+}
+
+// Complete the bulk load, flush the remaining nodes and commit the new root.
+// Number of entries loaded are returned by Count().
+func (b *Builder) Finish() (err error) {
+	if b.done {
+		return b.closedErr()
+	}
+	defer b.catch(&err)
+	var root Node
+	for level := 0; level < len(b.levels); level++ {
+		lv := &b.levels[level]
+		if lv.prev == nil && level == len(b.levels)-1 {
+			root = lv.cur
+			b.store.WStore.flushNode(root)
+			break
+		}
+		if lv.prev != nil {
+			b.balance(lv)
+			b.emit(level, lv.prev, lv.prevk, lv.prevd)
+			lv = &b.levels[level] // levels could have grown.
+		}
+		b.emit(level, lv.cur, lv.curk, lv.curd)
+	}
+	b.store.WStore.freelist.add(b.offsets)
+	b.offsets = b.offsets[:0]
+	b.mv.root = root.getLeafNode().fpos
+	b.done = true
+	b.store.OpEnd(true, b.mv, b.timestamp)
+	return nil
+}
+
+// Abort the bulk load, blocks used by the builder are returned to freelist
+// and the index is left empty.
+func (b *Builder) Abort() {
+	if b.done == false {
+		b.done = true
+		freelist := b.store.WStore.freelist
+		freelist.add(b.allocated)
+		freelist.add(b.offsets)
+		b.store.OpAbort(true, b.mv, b.timestamp)
+	}
+}
+
+// Number of entries added so far.
+func (b *Builder) Count() int64 {
+	return b.count
+}
+
+// Move `cur` node of `level` as `prev`, while `node` becomes the new `cur`
+// node with its first entry as {kfpos,dfpos}. Older `prev` is flushed.
+func (b *Builder) shift(level int, node Node, kfpos, dfpos int64) {
+	if lv := &b.levels[level]; lv.prev != nil {
+		b.emit(level, lv.prev, lv.prevk, lv.prevd)
+	}
+	lv := &b.levels[level] // levels could have grown.
+	lv.prev, lv.prevk, lv.prevd = lv.cur, lv.curk, lv.curd
+	lv.cur, lv.curk, lv.curd = node, kfpos, dfpos
+}
+
+// Flush `node` into its block and add it as a child of its parent level.
+// {kfpos,dfpos} is the first entry under `node`.
+func (b *Builder) emit(level int, node Node, kfpos, dfpos int64) {
+	b.store.WStore.flushNode(node)
+	if level+1 == len(b.levels) {
+		b.levels = append(b.levels, buildLevel{cur: b.newInode()})
+	}
+	lv := &b.levels[level+1]
+	in := lv.cur.(*inode)
+	if in.size == b.store.maxKeys() {
+		b.shift(level+1, b.newInode(), kfpos, dfpos)
+		lv = &b.levels[level+1] // levels could have grown.
+		in = lv.cur.(*inode)
+	}
+	fpos, count := node.getLeafNode().fpos, node.count(b.store)
+	if len(in.cs) == 0 { // first child
+		lv.curk, lv.curd = kfpos, dfpos
+		in.vs[0] = fpos
+		in.cs = append(in.cs, count)
+		return
+	}
+	in.ks = append(in.ks, kfpos)
+	in.ds = append(in.ds, dfpos)
+	in.vs = append(in.vs, fpos)
+	in.cs = append(in.cs, count)
+	in.size = len(in.ks)
+}
+
+// Balance the last two nodes of a level by moving entries from `prev` to
+// `cur`, if `cur` has fewer than `RebalanceThrs` entries.
+func (b *Builder) balance(lv *buildLevel) {
+	prev, cur := lv.prev.getLeafNode(), lv.cur.getLeafNode()
+	if cur.size >= b.store.RebalanceThrs {
+		return
+	}
+	m := (prev.size - cur.size) / 2
+	if m < 1 {
+		return
+	}
+	if lv.cur.isLeaf() {
+		n := prev.size
+		cur.ks = append(append(make([]int64, 0, cap(cur.ks)), prev.ks[n-m:]...), cur.ks...)
+		cur.ds = append(append(make([]int64, 0, cap(cur.ds)), prev.ds[n-m:]...), cur.ds...)
+		cur.vs = append(append(make([]int64, 0, cap(cur.vs)), prev.vs[n-m:n]...), cur.vs...)
+		prev.ks, prev.ds = prev.ks[:n-m], prev.ds[:n-m]
+		prev.vs = append(prev.vs[:n-m], 0)
+		lv.curk, lv.curd = cur.ks[0], cur.ds[0]
+	} else {
+		// move the last `m` children of prev, separator of first moved
+		// child becomes the first entry of `cur`.
+		n := len(prev.vs)
+		ks := append(make([]int64, 0, cap(cur.ks)), prev.ks[n-m:n-1]...)
+		ds := append(make([]int64, 0, cap(cur.ds)), prev.ds[n-m:n-1]...)
+		cur.ks = append(append(ks, lv.curk), cur.ks...)
+		cur.ds = append(append(ds, lv.curd), cur.ds...)
+		cur.vs = append(append(make([]int64, 0, cap(cur.vs)), prev.vs[n-m:]...), cur.vs...)
+		cur.cs = append(append(make([]int64, 0, cap(cur.cs)), prev.cs[n-m:]...), cur.cs...)
+		lv.curk, lv.curd = prev.ks[n-m-1], prev.ds[n-m-1]
+		prev.ks, prev.ds = prev.ks[:n-m-1], prev.ds[:n-m-1]
+		prev.vs, prev.cs = prev.vs[:n-m], prev.cs[:n-m]
+	}
+	prev.size, cur.size = len(prev.ks), len(cur.ks)
+}
+
+func (b *Builder) newLeaf() *lnode {
+	blk := (&block{leaf: TRUE}).newBlock(0, b.store.maxKeys())
+	return &lnode{block: *blk, fpos: b.alloc(), dirty: true}
+}
+
+func (b *Builder) newInode() *inode {
+	blk := (&block{leaf: FALSE}).newBlock(0, b.store.maxKeys())
+	blk.cs = blk.cs[:0]
+	return &inode{lnode: lnode{block: *blk, fpos: b.alloc(), dirty: true}}
+}
+
+// Allocate next block, blocks are appended to the index file in batches so
+// that the new tree is laid out sequentially.
+func (b *Builder) alloc() int64 {
+	if len(b.offsets) == 0 {
+		count := b.store.WStore.appendCount()
+		if count < 1 {
+			count = 1
+		}
+		b.offsets = b.store.WStore.appendBlocks(0, count)
+	}
+	fpos := b.offsets[0]
+	b.offsets = b.offsets[1:]
+	b.allocated = append(b.allocated, fpos)
+	return fpos
+}
+
+// Recover failure while building, the builder is aborted.
+func (b *Builder) catch(err *error) {
+	if r := recover(); r != nil {
+		b.err = recoverError(r)
+		b.Abort()
+		*err = b.err
+	}
+}
+
+func (b *Builder) closedErr() error {
+	if b.err != nil {
+		return b.err
+	}
+	return ErrClosed
+}
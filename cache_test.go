@@ -10,6 +10,7 @@
 package btree
 
 import (
+	"os"
 	"testing"
 )
 
@@ -85,3 +86,66 @@ func Benchmark_CacheLookup(b *testing.B) {
 		cache.cacheLookup(int64(i%count) << cache.rshift)
 	}
 }
+
+func Test_LeafCache(t *testing.T) {
+	store := testStore(true)
+	defer func() {
+		store.Destroy()
+	}()
+
+	lc := newLeafCache(4)
+	nodes := make([]Node, 0)
+	for i := 0; i < 6; i++ {
+		nodes = append(nodes, (&lnode{}).newNode(store))
+	}
+	fpos := func(i int) int64 { return nodes[i].getLeafNode().fpos }
+	for i := 0; i < 4; i++ {
+		lc.put(fpos(i), nodes[i])
+	}
+	// referenced leaves get a second chance.
+	lc.get(fpos(0))
+	lc.get(fpos(2))
+	lc.put(fpos(4), nodes[4])
+	if lc.size() != 4 || lc.evictions != 1 {
+		t.Fatalf("expected 4 leaves and 1 eviction, got %v %v", lc.size(), lc.evictions)
+	} else if lc.get(fpos(1)) != nil {
+		t.Fatalf("expected unreferenced leaf to be evicted")
+	}
+	for _, i := range []int{0, 2, 3, 4} {
+		if lc.get(fpos(i)) != nodes[i] {
+			t.Fatalf("expected leaf %v in cache", i)
+		}
+	}
+	lc.remove(fpos(0))
+	lc.put(fpos(5), nodes[5])
+	if lc.size() != 4 || lc.evictions != 1 || lc.get(fpos(0)) != nil {
+		t.Fatalf("expected removed leaf to make room without eviction")
+	}
+}
+
+func Test_LeafCacheBounded(t *testing.T) {
+	conf := testconf1
+	conf.MaxLeafCache = 16
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	bt := NewBTree(NewStore(conf))
+	defer func() {
+		bt.store.Destroy()
+	}()
+	wstore := bt.store.WStore
+	for i := 0; i < 5000; i++ {
+		bt.Insert(testKey(i), &TestValue{V: "value"})
+	}
+	bt.Drain()
+	for i := 0; i < 5000; i += 7 {
+		if _, ok, _ := bt.Get(testKey(i)); !ok {
+			t.Fatalf("missing key%05d", i)
+		}
+	}
+	if wstore.maxlenLC > int64(wstore.MaxLeafCache) {
+		t.Fatalf("expected leaf cache upto %v, got %v", wstore.MaxLeafCache, wstore.maxlenLC)
+	} else if wstore.lcEvictions() == 0 {
+		t.Fatalf("expected leaves to be evicted")
+	}
+	bt.Check()
+}
@@ -7,99 +7,103 @@
 //  either express or implied. See the License for the specific language governing permissions
 //  and limitations under the License.
 
+// Consistency check of index-file. When index is opened, configuration is
+// checked with the head, and if either copy of head or freelist fail to
+// validate, freelist is rebuilt by walking the btree from the root of the
+// picked head.
 package btree
 
 import (
+	"fmt"
+	"log"
 	"os"
+	"sort"
 )
 
+// Check whether configuration and freelist are consistent with index-file.
 func (store *Store) check() bool {
 	wstore := store.WStore
 	freelist := wstore.freelist
-	rfd, _ := os.Open(wstore.Idxfile)
-
-	// Check whether configuration settings match.
-	fi, _ := rfd.Stat()
-	fpos_firstblock := (wstore.Sectorsize * 2) - (wstore.Flistsize * 2)
-	blksize := fi.Size() - fpos_firstblock
-	if fpos_firstblock != wstore.fpos_firstblock {
+	if is_configSane(store) == false {
+		return false
+	}
+	fi, err := os.Stat(wstore.Idxfile)
+	if err != nil {
 		return false
 	}
-	if blksize%int64(wstore.Blocksize) != 0 {
+	if (fi.Size()-wstore.fpos_firstblock)%wstore.Blocksize != 0 {
 		return false
 	}
 
 	// Check freelist with btree.
-	root, _, _ := store.OpStart(false)
-	offs := root.listOffsets(store)
-	qsortOffsets(offs)
-	fulloffs := seq(wstore.fpos_firstblock, fi.Size(), int64(wstore.Blocksize))
-	offsets := make([]int64, 0, len(fulloffs))
-	i := 0
-	for _, x := range offs {
-		for i < len(fulloffs) {
-			if fulloffs[i] < x {
-				offsets = append(offsets, fulloffs[i])
-			} else if fulloffs[i] > x {
-				break
-			}
-			i++
-		}
-	}
-	for ; i < len(fulloffs); i++ {
-		offsets = append(offsets, fulloffs[i])
-	}
-	offsets = append(offsets, 0)
-	if len(offsets) != len(freelist.offsets) {
+	root, mv, timestamp := store.OpStart(false)
+	defer store.OpEnd(false, mv, timestamp)
+	offsets := store.freeBlocks(root)
+	free := make([]int64, 0, len(freelist.offsets)+len(freelist.chain))
+	free = append(free, freelist.offsets[:len(freelist.offsets)-1]...)
+	free = append(free, freelist.chain...)
+	if len(offsets) != len(free) {
 		return false
 	}
-
-	count := 0
-	for _, offset := range offsets {
-		for _, floffset := range freelist.offsets {
-			if offset == floffset {
-				count += 1
-				break
-			}
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	for i, offset := range offsets {
+		if offset != free[i] {
+			return false
 		}
 	}
-	if count != len(offsets) {
-		return false
-	}
 	return true
 }
 
-// Inplace quicksort
-func qsortOffsets(arr []int64) {
-	if len(arr) <= 1 {
-		return
+// Check index-file when the store is opened, rebuild the freelist if
+// either copy of head or freelist failed to validate.
+func (store *Store) checkOpen() (err error) {
+	wstore := store.WStore
+	if is_configSane(store) == false {
+		return fmt.Errorf(
+			"%w: sectorsize %v, flistsize %v, blocksize %v",
+			ErrConfig, wstore.head.sectorsize, wstore.head.flistsize,
+			wstore.head.blocksize)
 	}
-	iPivot := qsort_partition(arr)
-	qsortOffsets(arr[:iPivot])
-	qsortOffsets(arr[iPivot-1:])
-}
-
-func qsort_partition(arr []int64) int {
-	swap := func(arr []int64, i1, i2 int) {
-		arr[i1], arr[i2] = arr[i2], arr[i1]
+	defer catch(&err)
+	wstore.translock <- true
+	defer func() { <-wstore.translock }()
+	if wstore.rebuild {
+		log.Println("rebuilding freelist for", wstore.Idxfile)
+		store.rebuildFreelist()
+		wstore.rebuild = false
 	}
+	return nil
+}
 
-	idx, lastidx := 0, len(arr)-1
-	pivot := arr[lastidx] // rightmost element
-	for i := 1; i < len(arr); i++ {
-		if arr[i] < pivot {
-			swap(arr, i, idx)
-			idx++
-		}
-	}
-	swap(arr, lastidx, idx)
-	return idx
+// Rebuild freelist from blocks that are not reachable from head's root, and
+// flush them along with the head as the next generation.
+func (store *Store) rebuildFreelist() {
+	wstore := store.WStore
+	root := store.FetchNCache(wstore.head.root)
+	freelist := newFreeList(wstore)
+	freelist.add(store.freeBlocks(root))
+	wstore.freelist = freelist
+	wstore.flushHead(wstore.head.root, wstore.head.timestamp)
 }
 
-func seq(start, end, step int64) []int64 {
-	out := make([]int64, 0, (end-start)/step)
-	for i := start; i < end; i += step {
-		out = append(out, i)
+// Return blocks in index-file that are not reachable from `root`, in
+// ascending order of their file-position.
+func (store *Store) freeBlocks(root Node) []int64 {
+	wstore := store.WStore
+	size, err := wstore.idxWfd.Seek(0, os.SEEK_END)
+	if err != nil {
+		panic(err)
+	}
+	live := make(map[int64]bool)
+	for _, fpos := range root.listOffsets(store) {
+		live[fpos] = true
+	}
+	offsets := make([]int64, 0)
+	fpos := wstore.fpos_firstblock
+	for ; fpos+wstore.Blocksize <= size; fpos += wstore.Blocksize {
+		if live[fpos] == false {
+			offsets = append(offsets, fpos)
+		}
 	}
-	return out
+	return offsets
 }
@@ -0,0 +1,164 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Compaction for index-file. Index-file only grows by appending free blocks,
+// after large deletes free blocks are scattered all over the file.
+//
+// Compact() relocates live blocks from the tail of the index-file into free
+// blocks towards the front of the file. Relocated nodes and their parents
+// are copied within a transaction, like any other mutation, hence readers
+// continue on their snapshots. Blocks vacated by relocation become free only
+// after the snapshot is drained and readers of older snapshots are done,
+// till then they are not truncated.
+//
+// Vacuum() drains pending snapshots and truncates trailing free blocks from
+// the index-file. Trimmed freelist and head are flushed before the file is
+// truncated, so that on-disk freelist never refers to truncated blocks.
+package btree
+
+import (
+	"os"
+	"sort"
+)
+
+// Relocate live blocks towards the front of the index-file and truncate
+// trailing free blocks, including blocks vacated by relocation. Returns the
+// number of bytes truncated. If readers are on older snapshots, vacated
+// blocks are truncated by a later Vacuum(), after the readers are done.
+func (bt *BTree) Compact() (int64, error) {
+	err := bt.transaction(func(root Node, mv *MV) Node {
+		return bt.store.relocate(root, mv)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return bt.Vacuum()
+}
+
+// Drain pending snapshots and truncate trailing free blocks from the
+// index-file. Returns the number of bytes truncated. Blocks that readers of
+// older snapshots may refer to are not recycled, hence not truncated.
+func (bt *BTree) Vacuum() (n int64, err error) {
+	wstore := bt.store.WStore
+	if wstore == nil {
+		return 0, ErrClosed
+	}
+	defer catch(&err)
+	wstore.translock <- true
+	defer func() { <-wstore.translock }()
+	wstore.commit(nil, wstore.oldestAccess(), true) // recycle stale blocks.
+	return wstore.vacuum(), nil
+}
+
+// Relocate blocks beyond the cutoff, where the index-file would end if all
+// free blocks were at the tail, into free blocks before the cutoff.
+func (store *Store) relocate(root Node, mv *MV) Node {
+	wstore := store.WStore
+	fl := wstore.freelist
+	size, err := wstore.idxWfd.Seek(0, os.SEEK_END)
+	if err != nil {
+		panic(err)
+	}
+	free := fl.offsets[:len(fl.offsets)-1] // skip zero terminator
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	cutoff := size - int64(len(free))*wstore.Blocksize
+
+	// pop() shall return free blocks in ascending order.
+	movable := func(fpos int64) bool {
+		return fpos >= cutoff && fl.offsets[0] != 0 && fl.offsets[0] < cutoff
+	}
+	if rootfpos := root.getLeafNode().fpos; movable(rootfpos) {
+		mv.stale(rootfpos)
+		root = root.copyOnWrite(store)
+		mv.commits[root.getLeafNode().fpos] = root
+	}
+	height := 0
+	for node := root; node.isLeaf() == false; height++ {
+		node = store.fetchMV(node.(*inode).vs[0], mv)
+	}
+	if height > 0 {
+		store.relocateChildren(root.(*inode), height, mv, movable)
+	}
+	return root
+}
+
+// Relocate children of `in`, which is already copied, `height` is the
+// number of levels from `in` to leaf nodes.
+func (store *Store) relocateChildren(
+	in *inode, height int, mv *MV, movable func(int64) bool) {
+
+	for i, fpos := range in.vs {
+		in.vs[i] = store.relocateNode(fpos, height-1, mv, movable)
+	}
+}
+
+// Relocate node at `fpos` and its sub-tree, return its new file-position.
+// Nodes are copied if they are movable or if any of their children moved.
+func (store *Store) relocateNode(
+	fpos int64, height int, mv *MV, movable func(int64) bool) int64 {
+
+	if movable(fpos) {
+		node := store.copyMV(fpos, mv)
+		if height > 0 {
+			store.relocateChildren(node.(*inode), height, mv, movable)
+		}
+		return node.getLeafNode().fpos
+	} else if height == 0 {
+		return fpos
+	}
+	in := store.fetchMV(fpos, mv).(*inode)
+	for i, cfpos := range in.vs {
+		newfpos := store.relocateNode(cfpos, height-1, mv, movable)
+		if newfpos != cfpos {
+			if mv.commits[in.fpos] == nil {
+				in = store.copyMV(fpos, mv).(*inode)
+			}
+			in.vs[i] = newfpos
+		}
+	}
+	return in.fpos
+}
+
+// Truncate trailing free blocks, leaving enough free blocks for the next
+// few transactions. Caller must hold the transaction lock.
+func (wstore *WStore) vacuum() int64 {
+	fl := wstore.freelist
+	size, err := wstore.idxWfd.Seek(0, os.SEEK_END)
+	if err != nil {
+		panic(err)
+	}
+	free := make(map[int64]bool)
+	for _, fpos := range fl.offsets[:len(fl.offsets)-1] {
+		free[fpos] = true
+	}
+	end, reserve := size, wstore.Maxlevel*2
+	for end > wstore.fpos_firstblock && free[end-wstore.Blocksize] {
+		if len(free) <= reserve {
+			break
+		}
+		end -= wstore.Blocksize
+		delete(free, end)
+	}
+	if end == size {
+		return 0
+	}
+	offsets := make([]int64, 0, cap(fl.offsets))
+	for _, fpos := range fl.offsets {
+		if fpos < end { // includes zero terminator
+			offsets = append(offsets, fpos)
+		}
+	}
+	fl.offsets, fl.dirty = offsets, true
+	// on-disk freelist shall not refer to truncated blocks.
+	wstore.flushHead(wstore.head.root, wstore.head.timestamp)
+	if err := wstore.idxWfd.Truncate(end); err != nil {
+		panic(err)
+	}
+	return size - end
+}
@@ -31,10 +31,46 @@ func (in *inode) copyOnWrite(store *Store) Node {
 	copy(newin.ds, in.ds)
 	newin.vs = newin.vs[:len(in.vs)]
 	copy(newin.vs, in.vs)
+	newin.cs = newin.cs[:len(in.cs)]
+	copy(newin.cs, in.cs)
 	newin.size = len(in.ks)
 	return newin
 }
 
+// Fetch a node, identified by its file-position, for reading under
+// transaction `mv`. Nodes that are already copied within this transaction
+// are not yet visible in commitQ, hence looked up from `mv` first.
+func (store *Store) fetchMV(fpos int64, mv *MV) Node {
+	if node := mv.commits[fpos]; node != nil {
+		return node
+	}
+	return store.FetchMVCache(fpos)
+}
+
+// Fetch a node, identified by its file-position, for mutation under
+// transaction `mv`. If the node is not already copied within this
+// transaction, a copy is made and the original node is marked as stale.
+func (store *Store) copyMV(fpos int64, mv *MV) Node {
+	if node := mv.commits[fpos]; node != nil {
+		return node
+	}
+	stalenode := store.FetchMVCache(fpos)
+	node := stalenode.copyOnWrite(store)
+	mv.stales = append(mv.stales, fpos)
+	mv.commits[node.getLeafNode().fpos] = node
+	return node
+}
+
+// Mark nodes as stale under transaction `mv`. Nodes that were copied within
+// this transaction are never visible to readers, they are dropped from
+// commits and their blocks are reclaimed along with other stale nodes.
+func (mv *MV) stale(fposs ...int64) {
+	for _, fpos := range fposs {
+		delete(mv.commits, fpos)
+		mv.stales = append(mv.stales, fpos)
+	}
+}
+
 // Create a new instance of `lnode`, an in-memory representation of btree leaf
 // block.
 //   * `keys` slice must be half sized and zero valued, capacity of keys slice
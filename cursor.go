@@ -0,0 +1,338 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Pull based iteration over btree entries. Unlike channel based traversals,
+// a cursor does not spawn a goroutine, caller walks the tree at its own pace
+// and releases the snapshot by calling Close(). Typical usage,
+//
+//	cur := bt.Cursor()
+//	defer cur.Close()
+//	for ok := cur.Seek(key); ok; ok = cur.Next() {
+//	    keyb, docid, value := cur.Key(), cur.Docid(), cur.Value()
+//	}
+//	if err := cur.Err(); err != nil {
+//	    ...
+//	}
+//
+// Walk backwards from SeekLE() or Last() with Prev(). SeekPrefix() bounds the
+// cursor to keys starting with a prefix, Next() and Prev() return false once
+// they step out of the prefix.
+package btree
+
+import (
+	"bytes"
+)
+
+// Cursor holds on to the snapshot it was created from, stale nodes of the
+// snapshot cannot be reclaimed until the cursor is closed.
+type Cursor struct {
+	store     *Store
+	root      Node
+	timestamp int64
+	stack     []cursorPos // path of inodes from root to current leaf.
+	leaf      *lnode      // current leaf, nil if cursor is not positioned.
+	index     int         // position of current entry in `leaf`.
+	closed    bool
+	err       error  // failure while walking the snapshot.
+	prefix    []byte // if not nil, cursor is bounded to keys with prefix.
+	off       int    // 1 if cursor stepped past the bound, -1 if before.
+}
+
+// position of a cursor within an intermediate node.
+type cursorPos struct {
+	in    *inode
+	index int // index into `in.vs` for the child being walked.
+}
+
+// Create a new cursor on the latest snapshot of the btree. Cursor is not
+// positioned until Seek(), Last(), Next() or Prev() is called. If the
+// snapshot cannot be read, cursor is returned closed and Err() tells why.
+func (bt *BTree) Cursor() (cur *Cursor) {
+	if bt.store.WStore == nil {
+		return &Cursor{closed: true, err: ErrClosed}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			cur = &Cursor{closed: true, err: recoverError(r)}
+		}
+	}()
+	root, _, timestamp := bt.store.OpStart(false)
+	cur = &Cursor{
+		store:     bt.store,
+		root:      root,
+		timestamp: timestamp,
+		stack:     make([]cursorPos, 0, bt.Maxlevel),
+	}
+	return cur
+}
+
+// Position the cursor on the first entry that is greater than or equal to
+// {key,docid}. If `key` is nil, cursor is positioned on the first entry.
+// Returns false if there is no such entry.
+func (cur *Cursor) Seek(key Key) (ok bool) {
+	if cur.closed || cur.err != nil {
+		return false
+	}
+	defer cur.catch()
+	cur.prefix, cur.off = nil, 0
+	store := cur.store
+	cur.stack = cur.stack[:0]
+	node := cur.root
+	for node.isLeaf() == false {
+		in := node.(*inode)
+		index := 0
+		if key != nil {
+			var kfpos, dfpos int64
+			index, kfpos, dfpos = in.searchGE(store, key, true)
+			if kfpos >= 0 && dfpos >= 0 { // separator is the first entry of right
+				index += 1
+			}
+		}
+		cur.stack = append(cur.stack, cursorPos{in: in, index: index})
+		node = store.FetchNCache(in.vs[index])
+	}
+	cur.leaf, cur.index = node.(*lnode), 0
+	if key != nil {
+		cur.index, _, _ = cur.leaf.searchGE(store, key, true)
+	}
+	if cur.index < cur.leaf.size {
+		return true
+	}
+	return cur.nextLeaf()
+}
+
+// Position the cursor on the last entry that is less than or equal to
+// {key,docid}, a starting point for walking a range backwards with Prev(). If
+// `key` is nil, cursor is positioned on the last entry. Returns false if
+// there is no such entry.
+func (cur *Cursor) SeekLE(key Key) (ok bool) {
+	if key == nil {
+		return cur.Last()
+	} else if ok = cur.Seek(key); cur.err != nil {
+		return false
+	} else if ok && cur.equal(key) {
+		return true
+	}
+	return cur.Prev()
+}
+
+// Position the cursor on the last entry. Returns false if the index is
+// empty.
+func (cur *Cursor) Last() (ok bool) {
+	if cur.closed || cur.err != nil {
+		return false
+	}
+	defer cur.catch()
+	cur.prefix, cur.off = nil, 0
+	store := cur.store
+	cur.stack = cur.stack[:0]
+	node := cur.root
+	for node.isLeaf() == false { // right most path
+		in := node.(*inode)
+		cur.stack = append(cur.stack, cursorPos{in: in, index: in.size})
+		node = store.FetchNCache(in.vs[in.size])
+	}
+	cur.leaf = node.(*lnode)
+	cur.index = cur.leaf.size - 1
+	if cur.index >= 0 {
+		return true
+	}
+	return cur.prevLeaf()
+}
+
+// Position the cursor on the first entry whose key starts with `prefix`.
+// Next() and Prev() are bounded to such entries until the cursor is
+// positioned again. Applicable only when `Key` types sort byte-wise on
+// Bytes(). Returns false if there is no such entry.
+func (cur *Cursor) SeekPrefix(prefix []byte) (ok bool) {
+	ok = cur.Seek(&prefixKey{prefix: prefix})
+	cur.prefix = prefix
+	defer cur.catch()
+	return cur.bounded(ok, 1)
+}
+
+// Move the cursor to the next entry. If the cursor is not yet positioned, it
+// is moved to the first entry. Returns false if there are no more entries.
+func (cur *Cursor) Next() (ok bool) {
+	if cur.closed || cur.err != nil {
+		return false
+	} else if cur.leaf == nil {
+		return cur.Seek(nil)
+	} else if cur.off > 0 || cur.index >= cur.leaf.size {
+		return false
+	}
+	defer cur.catch()
+	cur.off = 0
+	cur.index += 1
+	if cur.index < cur.leaf.size {
+		return cur.bounded(true, 1)
+	}
+	return cur.bounded(cur.nextLeaf(), 1)
+}
+
+// Move the cursor to the previous entry. If the cursor is not yet
+// positioned, it is moved to the last entry. Returns false if there are no
+// more entries.
+func (cur *Cursor) Prev() (ok bool) {
+	if cur.closed || cur.err != nil {
+		return false
+	} else if cur.leaf == nil {
+		return cur.Last()
+	} else if cur.off < 0 || cur.index < 0 {
+		return false
+	}
+	defer cur.catch()
+	cur.off = 0
+	cur.index -= 1
+	if cur.index >= 0 {
+		return cur.bounded(true, -1)
+	}
+	return cur.bounded(cur.prevLeaf(), -1)
+}
+
+// Return key-bytes of the current entry, nil if cursor is not positioned on
+// an entry.
+func (cur *Cursor) Key() (b []byte) {
+	if cur.valid() {
+		defer cur.catch()
+		return cur.store.fetchKey(cur.leaf.ks[cur.index])
+	}
+	return nil
+}
+
+// Return docid-bytes of the current entry, nil if cursor is not positioned
+// on an entry.
+func (cur *Cursor) Docid() (b []byte) {
+	if cur.valid() {
+		defer cur.catch()
+		return cur.store.fetchDocid(cur.leaf.ds[cur.index])
+	}
+	return nil
+}
+
+// Return value-bytes of the current entry, nil if cursor is not positioned
+// on an entry.
+func (cur *Cursor) Value() (b []byte) {
+	if cur.valid() {
+		defer cur.catch()
+		return cur.store.fetchValue(cur.leaf.vs[cur.index])
+	}
+	return nil
+}
+
+// Return the first failure encountered while walking the snapshot, like
+// ErrCorrupt. Once failed, cursor cannot be positioned any more.
+func (cur *Cursor) Err() error {
+	return cur.err
+}
+
+// Release the snapshot held by this cursor. It is safe to call Close() more
+// than once.
+func (cur *Cursor) Close() {
+	if cur.closed == false {
+		cur.store.OpEnd(false, nil, cur.timestamp)
+		cur.closed = true
+		cur.root, cur.leaf, cur.stack = nil, nil, nil
+	}
+}
+
+// Recover failure while walking the snapshot, remember it for Err().
+func (cur *Cursor) catch() {
+	if r := recover(); r != nil {
+		cur.err = recoverError(r)
+		cur.leaf = nil
+	}
+}
+
+func (cur *Cursor) valid() bool {
+	return cur.closed == false && cur.leaf != nil && cur.off == 0 &&
+		cur.index >= 0 && cur.index < cur.leaf.size
+}
+
+// Check whether cursor, moved in direction `dir`, is positioned on an entry
+// within its prefix bound. Otherwise the cursor is marked as off the bound.
+func (cur *Cursor) bounded(ok bool, dir int) bool {
+	if ok && cur.prefix != nil {
+		keyb := cur.store.fetchKey(cur.leaf.ks[cur.index])
+		if bytes.HasPrefix(keyb, cur.prefix) == false {
+			cur.off = dir
+			return false
+		}
+	}
+	return ok
+}
+
+// Check whether cursor is positioned on the entry {key,docid}.
+func (cur *Cursor) equal(key Key) (eq bool) {
+	defer cur.catch()
+	ks, ds := cur.leaf.ks, cur.leaf.ds
+	cmp, _, _ := key.CompareLess(cur.store, ks[cur.index], ds[cur.index], true)
+	return cmp == 0
+}
+
+// Move to the first entry of the next leaf. If there is no next leaf, cursor
+// is left past the last entry of the current leaf.
+func (cur *Cursor) nextLeaf() bool {
+	for {
+		level := len(cur.stack) - 1
+		for ; level >= 0; level-- {
+			if cur.stack[level].index < cur.stack[level].in.size {
+				break
+			}
+		}
+		if level < 0 {
+			cur.index = cur.leaf.size
+			return false
+		}
+		cur.stack = cur.stack[:level+1]
+		cur.stack[level].index += 1
+		pos := cur.stack[level]
+		node := cur.store.FetchNCache(pos.in.vs[pos.index])
+		for node.isLeaf() == false { // left most path
+			in := node.(*inode)
+			cur.stack = append(cur.stack, cursorPos{in: in, index: 0})
+			node = cur.store.FetchNCache(in.vs[0])
+		}
+		cur.leaf, cur.index = node.(*lnode), 0
+		if cur.leaf.size > 0 {
+			return true
+		}
+	}
+}
+
+// Move to the last entry of the previous leaf. If there is no previous leaf,
+// cursor is left before the first entry of the current leaf.
+func (cur *Cursor) prevLeaf() bool {
+	for {
+		level := len(cur.stack) - 1
+		for ; level >= 0; level-- {
+			if cur.stack[level].index > 0 {
+				break
+			}
+		}
+		if level < 0 {
+			cur.index = -1
+			return false
+		}
+		cur.stack = cur.stack[:level+1]
+		cur.stack[level].index -= 1
+		pos := cur.stack[level]
+		node := cur.store.FetchNCache(pos.in.vs[pos.index])
+		for node.isLeaf() == false { // right most path
+			in := node.(*inode)
+			cur.stack = append(cur.stack, cursorPos{in: in, index: in.size})
+			node = cur.store.FetchNCache(in.vs[in.size])
+		}
+		cur.leaf = node.(*lnode)
+		cur.index = cur.leaf.size - 1
+		if cur.leaf.size > 0 {
+			return true
+		}
+	}
+}
@@ -111,7 +111,7 @@ func doDefer(wstore *WStore) {
 				force := cmd[3].(bool)
 				hdts := wstore.head.timestamp
 
-				if throttleMVCC(wstore, minAccess, hdts) {
+				if force == false && throttleMVCC(wstore, minAccess, hdts) {
 					syncChan <- nil
 					continue
 				}
@@ -136,7 +136,7 @@ func doDefer(wstore *WStore) {
 				}
 
 				wstore.flushSnapshot(commitQ, recycleQ, mvroot, mvts, force)
-				wstore.setSnapShot(recycleQ, mvroot, mvts)
+				wstore.setSnapShot(mvroot, mvts)
 
 				// Update btree's ping cache
 				for _, node := range commitQ {
@@ -200,17 +200,22 @@ func snapshotToCommit(wstore *WStore, hdts int64) ([]Node, *MV) {
 	return commitQ, snapshot
 }
 
-// Gather RecycleQ
+// Gather RecycleQ. Snapshots are force recycled only when there are no
+// readers, `minAccess` is zero, otherwise readers may be on older snapshots.
 func recycleSnapshot(wstore *WStore, minAccess, hdts int64, force bool) []int64 {
 	recycleQ := make([]int64, 0, wstore.DrainRate*wstore.Maxlevel)
 	if minAccess == 0 || hdts == 0 || minAccess > hdts {
 		skip := 0
 		for _, mvp := range wstore.mvQ {
 			// If all of them are false break out of the loop
-			if !(force || hdts == 0 || (mvp.timestamp < hdts)) {
+			if !((force && minAccess == 0) || hdts == 0 || (mvp.timestamp < hdts)) {
 				break
 			}
 			recycleQ = append(recycleQ, mvp.stales...)
+			// no reader refers to snapshots older than `mvp`.
+			if mvp.kvretire != nil {
+				wstore.retireKV(mvp.kvretire)
+			}
 			for _, fpos := range mvp.stales {
 				delete(wstore.commitQ, fpos)
 				wstore._pingCacheEvict(fpos)
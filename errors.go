@@ -0,0 +1,60 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Errors returned by btree APIs. Deep inside the algorithm, failures are
+// raised as panic with an error value, wrapping one of the following
+// sentinel errors where applicable. Error returning APIs recover them at the
+// API boundary, so callers can check them using errors.Is().
+package btree
+
+import (
+	"errors"
+	"runtime"
+)
+
+var (
+	// index-file or kv-file contains unexpected data.
+	ErrCorrupt = errors.New("btree: corrupt index")
+	// requested entry is not present in the index.
+	ErrNotFound = errors.New("btree: entry not found")
+	// configuration does not match with index-file.
+	ErrConfig = errors.New("btree: config mismatch")
+	// file is not a btree index-file.
+	ErrFormat = errors.New("btree: not an index file")
+	// on-disk format version of index-file is not supported.
+	ErrVersion = errors.New("btree: unsupported index version")
+	// store or btree is already closed.
+	ErrClosed = errors.New("btree: store closed")
+	// operation cannot be performed on an empty index.
+	ErrEmptyIndex = errors.New("btree: empty index")
+	// {key,docid} entry is already present in the index.
+	ErrDuplicate = errors.New("btree: duplicate entry")
+	// bulk load can only be done on an empty index.
+	ErrNotEmpty = errors.New("btree: index not empty")
+	// bulk load entries are not in ascending sort order.
+	ErrUnsorted = errors.New("btree: entries not in sort order")
+)
+
+// Convert a recovered panic value into error. Panics that are not raised
+// with an error value, and runtime errors, are bugs and propagated as is.
+func recoverError(r interface{}) error {
+	if err, ok := r.(error); ok {
+		if _, ok = r.(runtime.Error); !ok {
+			return err
+		}
+	}
+	panic(r)
+}
+
+// Deferred by error returning APIs to recover failures as `err`.
+func catch(err *error) {
+	if r := recover(); r != nil {
+		*err = recoverError(r)
+	}
+}
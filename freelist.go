@@ -8,11 +8,23 @@
 //  and limitations under the License.
 
 // Manages list of free blocks in btree index-file.
+//
+// Free blocks are listed in a freelist block of `Flistsize` bytes, two
+// copies of which follow the head sectors, flushed alternately along with
+// the head sector. Its last slot links a chain of
+// overflow blocks, each of `Blocksize` bytes and laid out as,
+//
+//	| next int64 | count uint32 | crc uint32 | offsets [count]int64 |
+//
+// such that free blocks are never dropped, whatever be the `Flistsize`.
+// Overflow blocks are taken from the freelist itself, every flush writes a
+// fresh chain, and the previous chain is released only after the head,
+// that refers to the new freelist, is flushed.
 package btree
 
 import (
-	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 	"log"
 	"os"
@@ -21,13 +33,18 @@ import (
 // Structure to manage the free list
 type FreeList struct {
 	wstore      *WStore
-	dirty       bool  // Tells whether `freelist` contain side-effects
-	fpos_block1 int64 // file-offset into index file where 1st-list is
-	fpos_block2 int64 // file-offset into index file where 2nd-list is
+	dirty       bool    // Tells whether `freelist` contain side-effects
+	fpos_block1 int64   // file-offset into index file where 1st-list is
+	fpos_block2 int64   // file-offset into index file where 2nd-list is
+	popped      []int64 // blocks popped by on-going transaction.
+	chain       []int64 // overflow blocks holding the persisted freelist.
+	released    []int64 // overflow blocks of previous flush.
 	// Following fields are persisted on disk.
 	offsets []int64 // array(slice) of free blocks
 }
 
+const FLBLK_HEADER_SIZE = 16 // header size of overflow block.
+
 var crctab = crc32.MakeTable(crc32.IEEE)
 
 // Create a new FreeList structure
@@ -43,106 +60,219 @@ func newFreeList(wstore *WStore) *FreeList {
 	return &fl
 }
 
-// Clone `fl` to `newfl` with new array of offsets.
-func (fl *FreeList) clone() *FreeList {
-	newfl := newFreeList(fl.wstore)
-	newfl.dirty = fl.dirty
-	newfl.offsets = newfl.offsets[:len(fl.offsets)]
-	copy(newfl.offsets, fl.offsets)
-	return newfl
-}
-
-// Fetch list of free blocks from index file.
-func (fl *FreeList) fetch(crc uint32) bool {
-	var fpos int64
+// Fetch list of free blocks from copy `slot` in index file, along with its
+// overflow blocks.
+func (fl *FreeList) fetch(slot int, crc uint32) bool {
 	if fl.dirty {
 		panic("Cannot read index head when in-memory copy is dirty")
 	}
 
 	// Open the index file in read mode.
 	wstore := fl.wstore
-	rfd, _ := os.Open(wstore.Idxfile)
+	rfd, err := os.Open(wstore.Idxfile)
+	if err != nil {
+		panic(err)
+	}
+	defer rfd.Close()
 
 	// Read the first block
 	bytebuf := make([]byte, wstore.Flistsize)
-	if _, err := rfd.ReadAt(bytebuf, fl.fpos_block1); err != nil {
-		panic(err.Error())
+	if _, err := rfd.ReadAt(bytebuf, fl.fposBlock(slot)); err != nil {
+		panic(fmt.Errorf("%w: reading freelist, %v", ErrCorrupt, err))
 	}
 	// Load the offsets
-	fl.offsets = fl.offsets[:0]
-	buf := bytes.NewBuffer(bytebuf)
-	for i := 0; i < wstore.maxFreeBlocks(); i++ {
-		binary.Read(buf, binary.LittleEndian, &fpos)
-		fl.offsets = append(fl.offsets, int64(fpos)) // include zero-terminator
+	slots := wstore.maxFreeBlocks() - 1 // last slot links overflow blocks.
+	fl.offsets, fl.chain = fl.offsets[:0], fl.chain[:0]
+	for i := 0; i < slots; i++ {
+		fpos := int64(binary.LittleEndian.Uint64(bytebuf[i*OFFSET_SIZE:]))
 		if fpos == 0 {
 			break
 		}
+		fl.offsets = append(fl.offsets, fpos)
 	}
 
 	// verify the crc.
 	crc1 := crc32.Checksum(bytebuf, crctab)
 	if crc != crc1 {
+		fl.offsets = append(fl.offsets, 0) // zero-terminator
 		return false
 	}
+	next := int64(binary.LittleEndian.Uint64(bytebuf[slots*OFFSET_SIZE:]))
+	ok, chained := true, make(map[int64]bool)
+	for ok && next != 0 && chained[next] == false {
+		chained[next] = true
+		fl.chain = append(fl.chain, next)
+		next, ok = fl.fetchOverflow(rfd, next)
+	}
+	ok = ok && next == 0
+	fl.offsets = append(fl.offsets, 0) // zero-terminator
+	return ok && fl.validate(rfd)
+}
 
-	// Verify with the second block
-	bytebuf_ := make([]byte, wstore.Flistsize)
-	if _, err := rfd.ReadAt(bytebuf_, fl.fpos_block2); err != nil {
-		panic(err.Error())
+// Load offsets from overflow block at `fpos`, return file-position of the
+// next overflow block. Return false if overflow block is corrupt.
+func (fl *FreeList) fetchOverflow(rfd *os.File, fpos int64) (int64, bool) {
+	data := make([]byte, fl.wstore.Blocksize)
+	if _, err := rfd.ReadAt(data, fpos); err != nil {
+		return 0, false
 	}
-	return bytes.Equal(bytebuf, bytebuf_)
+	next := int64(binary.LittleEndian.Uint64(data[0:]))
+	count := int(binary.LittleEndian.Uint32(data[8:]))
+	if count > fl.wstore.overflowSlots() {
+		return 0, false
+	}
+	offsets := data[FLBLK_HEADER_SIZE : FLBLK_HEADER_SIZE+count*OFFSET_SIZE]
+	if binary.LittleEndian.Uint32(data[12:]) != overflowCRC(data[:8+4], offsets) {
+		return 0, false
+	}
+	for i := 0; i < count; i++ {
+		fl.offsets = append(fl.offsets, int64(binary.LittleEndian.Uint64(offsets[i*OFFSET_SIZE:])))
+	}
+	return next, true
 }
 
-// Add a list of offsets to free blocks. By adding `offsets` into the
-// freelist, length of freelist must not exceed `maxFreeBlocks()+1`.
+// Validate that free blocks and overflow blocks are distinct blocks within
+// the index-file.
+func (fl *FreeList) validate(rfd *os.File) bool {
+	wstore := fl.wstore
+	fi, err := rfd.Stat()
+	if err != nil {
+		panic(err)
+	}
+	seen := make(map[int64]bool)
+	valid := func(fpos int64) bool {
+		if fpos < wstore.fpos_firstblock || fpos+wstore.Blocksize > fi.Size() {
+			return false
+		} else if (fpos-wstore.fpos_firstblock)%wstore.Blocksize != 0 || seen[fpos] {
+			return false
+		}
+		seen[fpos] = true
+		return true
+	}
+	for _, fpos := range fl.offsets[:len(fl.offsets)-1] {
+		if valid(fpos) == false {
+			return false
+		}
+	}
+	for _, fpos := range fl.chain {
+		if valid(fpos) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// Add a list of offsets to free blocks.
 func (fl *FreeList) add(offsets []int64) *FreeList {
 	if len(offsets) > 0 {
-		max := fl.wstore.maxFreeBlocks()
 		ln := len(fl.offsets)
 		fl.offsets = append(fl.offsets[:ln-1], offsets...)
-		if (ln + len(offsets)) > max {
-			fl.wstore.garbageBlocks += int64(max - ln - len(offsets))
-			fl.offsets = fl.offsets[:max-1]
-		}
 		fl.offsets = append(fl.offsets, 0) // Zero terminator
 		fl.dirty = true
 	}
 	return fl
 }
 
-// Get a freeblock
+// Get a freeblock. If freelist has gone empty, new free blocks are appended
+// to the index-file.
 func (fl *FreeList) pop() int64 {
 	if fl.offsets[0] == 0 {
-		panic("Freelist is not expected to go empty")
+		fl.add(fl.wstore.appendBlocks(0, fl.wstore.appendCount()))
+		if fl.offsets[0] == 0 {
+			panic(fmt.Errorf("unable to append free blocks to %v", fl.wstore.Idxfile))
+		}
 	}
 	fpos := fl.offsets[0]
 	fl.offsets = fl.offsets[1:]
+	fl.popped = append(fl.popped, fpos)
 	fl.wstore.popCounts += 1 // stats
 	return fpos
 }
 
-func (fl *FreeList) flush() uint32 {
-	buf := bytes.NewBuffer([]byte{})
-	// Zero fill offsets
-	count := fl.wstore.maxFreeBlocks() - len(fl.offsets)
-	offsets := append(fl.offsets, make([]int64, count)...)
-	// Dump offsets
-	for _, fpos := range offsets {
-		binary.Write(buf, binary.LittleEndian, &fpos)
-	}
-	bytebuf := buf.Bytes()
-	// Write into the second copy
-	wfd := fl.wstore.idxWfd
-	wfd.WriteAt(bytebuf, fl.fpos_block2) // Write the second copy
-	wfd.WriteAt(bytebuf, fl.fpos_block1) // Write the first copy
-
-	fl.wstore.flushFreelists += 1
+// Flush freelist into copy `slot` and return its crc. Offsets that don't fit
+// in the freelist block are written into a new chain of overflow blocks,
+// caller shall release() the previous chain after flushing the head.
+func (fl *FreeList) flush(slot int) uint32 {
+	wstore := fl.wstore
+	slots, per := wstore.maxFreeBlocks()-1, wstore.overflowSlots()
+	free := fl.offsets[:len(fl.offsets)-1]
+	fl.released, fl.chain = append(fl.released, fl.chain...), nil
+	for len(free)-slots > len(fl.chain)*per {
+		fl.chain = append(fl.chain, free[len(free)-1])
+		free = free[:len(free)-1]
+	}
+	fl.offsets = append(free, 0) // Zero terminator
+
+	// Write the overflow blocks
+	var overflow []int64
+	if len(free) > slots {
+		free, overflow = free[:slots], free[slots:]
+	}
+	for i, fpos := range fl.chain {
+		var next int64
+		if i < len(fl.chain)-1 {
+			next = fl.chain[i+1]
+		}
+		n := len(overflow)
+		if n > per {
+			n = per
+		}
+		fl.flushOverflow(fpos, next, overflow[:n])
+		overflow = overflow[n:]
+	}
+
+	// Dump offsets, zero filled, and link to the overflow blocks.
+	bytebuf := make([]byte, wstore.Flistsize)
+	for i, fpos := range free {
+		binary.LittleEndian.PutUint64(bytebuf[i*OFFSET_SIZE:], uint64(fpos))
+	}
+	if len(fl.chain) > 0 {
+		binary.LittleEndian.PutUint64(bytebuf[slots*OFFSET_SIZE:], uint64(fl.chain[0]))
+	}
+	if _, err := wstore.idxWfd.WriteAt(bytebuf, fl.fposBlock(slot)); err != nil {
+		panic(err)
+	}
+
+	wstore.flushFreelists += 1
 	fl.dirty = false
 
 	crc := crc32.Checksum(bytebuf, crctab)
 	return crc
 }
 
+// Write `offsets` into overflow block at `fpos`, linked to `next`.
+func (fl *FreeList) flushOverflow(fpos, next int64, offsets []int64) {
+	data := make([]byte, fl.wstore.Blocksize)
+	binary.LittleEndian.PutUint64(data[0:], uint64(next))
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(offsets)))
+	buf := data[FLBLK_HEADER_SIZE : FLBLK_HEADER_SIZE+len(offsets)*OFFSET_SIZE]
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint64(buf[i*OFFSET_SIZE:], uint64(offset))
+	}
+	binary.LittleEndian.PutUint32(data[12:], overflowCRC(data[:8+4], buf))
+	if _, err := fl.wstore.idxWfd.WriteAt(data, fpos); err != nil {
+		panic(err)
+	}
+}
+
+// Overflow blocks of previous flush are free once the head, referring to
+// the latest flush, is on disk.
+func (fl *FreeList) release() {
+	fl.add(fl.released)
+	fl.released = nil
+}
+
+func (fl *FreeList) fposBlock(slot int) int64 {
+	if slot == 0 {
+		return fl.fpos_block1
+	}
+	return fl.fpos_block2
+}
+
+func overflowCRC(hdr, offsets []byte) uint32 {
+	return crc32.Update(crc32.Checksum(hdr, crctab), crctab, offsets)
+}
+
 func (fl *FreeList) assertNotMember(fpos int64) {
 	if fl.wstore.Debug {
 		for _, offset := range fl.offsets {
@@ -39,3 +39,65 @@ func Test_fetchFreelist(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_overflowFreelist(t *testing.T) {
+	store := testStore(true)
+	defer func() {
+		store.Destroy()
+	}()
+
+	wstore := store.WStore
+	freelist := wstore.freelist
+	count := len(freelist.offsets) - 1
+	freelist.add(wstore.appendBlocks(0, wstore.maxFreeBlocks()*3))
+	count += wstore.maxFreeBlocks() * 3
+	for i := 0; i < 2; i++ { // second flush releases the first chain.
+		crc := freelist.flush(wstore.head.nextSlot())
+		wstore.head.flush(crc)
+		freelist.release()
+		if len(freelist.chain) == 0 {
+			t.Fatalf("expected overflow blocks")
+		} else if n := len(freelist.offsets) - 1 + len(freelist.chain); n != count {
+			t.Fatalf("expected %v free blocks, got %v", count, n)
+		}
+		crc = freelist.flush(wstore.head.nextSlot())
+		wstore.head.flush(crc)
+
+		fl := newFreeList(wstore)
+		if fl.fetch(wstore.head.slot(), crc) == false {
+			t.Fatalf("mismatch in freelist")
+		}
+		free := make(map[int64]bool)
+		for _, fpos := range fl.offsets[:len(fl.offsets)-1] {
+			free[fpos] = true
+		}
+		for _, fpos := range freelist.offsets[:len(freelist.offsets)-1] {
+			if free[fpos] == false {
+				t.Fatalf("expected %v in freelist", fpos)
+			}
+			delete(free, fpos)
+		}
+		if len(free) != 0 || len(fl.chain) != len(freelist.chain) {
+			t.Fatalf("expected %v overflow blocks, got %v", freelist.chain, fl.chain)
+		}
+	}
+
+	// tools read the freelist along with its overflow blocks.
+	heads, pick, err := ReadHeads(wstore.Idxfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadFreelist(wstore.Idxfile, heads[pick], pick)
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Valid == false || len(info.Offsets) != len(freelist.offsets)-1 {
+		t.Fatalf("expected %v free blocks, got %v", len(freelist.offsets)-1, len(info.Offsets))
+	} else if len(info.Chain) != len(freelist.chain) {
+		t.Fatalf("expected %v overflow blocks, got %v", freelist.chain, info.Chain)
+	}
+	for i, fpos := range freelist.chain {
+		if info.Chain[i] != fpos {
+			t.Fatalf("expected %v overflow blocks, got %v", freelist.chain, info.Chain)
+		}
+	}
+}
@@ -17,14 +17,48 @@
 //      maxkeys int64
 //      pick int64
 //      crc uint32
+//      format byte
+//      kvformat byte
+//      kvbase int64
+//      magic uint32
+//      major uint16
+//      minor uint16
+//      created int64
+// and the last 4 bytes of the sector carry CRC32 of the sector.
+//
+// `magic` identifies the file as btree index-file, and `major`, `minor` is
+// the version of on-disk format. Index files created before versioning was
+// introduced read them as zero, and are upgraded in-place, refer
+// migrate.go.
+//
+// Index-file has two head sectors and two freelist blocks, head and
+// freelist are flushed together as a generation, alternating between the
+// first copy and the second copy. When opening the index, newest generation
+// whose CRCs validate is picked, hence a torn write falls back to the
+// previous generation.
 package btree
 
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"os"
 )
 
+// Identifies btree index-file, reads as "gbtr" in a dump of head sector.
+const HEAD_MAGIC uint32 = 0x72746267
+
+// Version of on-disk format. Major version is bumped for changes that older
+// versions cannot read, minor version for compatible changes.
+const (
+	INDEX_MAJOR uint16 = 1
+	INDEX_MINOR uint16 = 0
+)
+
+// Encoded size of head, excluding CRC at the end of the sector.
+const HEAD_SIZE = 86
+
 // Structure to manage the head sector
 type Head struct {
 	wstore     *WStore
@@ -38,8 +72,15 @@ type Head struct {
 	flistsize  int64  // free-list size in bytes.
 	blocksize  int64  // btree block size in bytes.
 	maxkeys    int64  // Maximum number of keys can be store in btree block.
-	pick       int64  // either 0 or 1, which freelist to pick. NOT USED !!
-	crc        uint32 // CRC value for head sector + freelist block
+	pick       int64  // generation, flushed into copy `pick%2`.
+	crc        uint32 // CRC value for freelist block
+	format     byte   // encoding format of btree blocks, BLOCK_GOB or BLOCK_BINARY
+	kvformat   byte   // entry format in kv-file, KV_PLAIN or KV_CHECKSUM
+	kvbase     int64  // file-position of the first byte of kv-file.
+	magic      uint32 // HEAD_MAGIC
+	major      uint16 // major version of on-disk format.
+	minor      uint16 // minor version of on-disk format.
+	created    int64  // creation time of index-file, in unix nanoseconds.
 }
 
 // Create a new Head sector structure.
@@ -62,60 +103,138 @@ func newHead(wstore *WStore) *Head {
 func (hd *Head) clone() *Head {
 	newhd := newHead(hd.wstore)
 	newhd.pick = hd.pick
+	newhd.maxkeys = hd.maxkeys
+	newhd.format = hd.format
+	newhd.kvformat = hd.kvformat
+	newhd.kvbase = hd.kvbase
+	newhd.magic = hd.magic
+	newhd.major = hd.major
+	newhd.minor = hd.minor
+	newhd.created = hd.created
 	newhd.dirty = hd.dirty
 	newhd.root = hd.root
 	newhd.timestamp = hd.timestamp
 	return newhd
 }
 
-// Fetch head sector from index file, read root block's file position and
-// check whether head1 and head2 copies are consistent.
+// Fetch newest generation of head sector, whose CRC and CRC of its freelist
+// block validate, from index file. Returns false if either copy failed to
+// validate.
 func (hd *Head) fetch() bool {
-	LittleEndian := binary.LittleEndian
 	if hd.dirty {
 		panic("Cannot read index head when in-memory copy is dirty")
 	}
-	rfd, _ := os.Open(hd.wstore.Idxfile)
-
-	data1 := make([]byte, hd.sectorsize) // Read from first sector
-	data2 := make([]byte, hd.sectorsize) // Read from second sector
-	if _, err := rfd.ReadAt(data1, hd.fpos_head1); err != nil {
+	heads, valid, pick, err := readHeads(hd.wstore.Idxfile, hd.sectorsize)
+	if err != nil {
 		panic(err)
 	}
-	if _, err := rfd.ReadAt(data2, hd.fpos_head2); err != nil {
-		panic(err)
+	newhd := heads[pick]
+	newhd.wstore, newhd.dirty = hd.wstore, false
+	newhd.fpos_head1, newhd.fpos_head2 = hd.fpos_head1, hd.fpos_head2
+	*hd = *newhd
+	return valid[0] && valid[1]
+}
+
+// Verify CRC of freelist block for copy `slot`, from index file of `size`
+// bytes.
+func (hd *Head) verifyFreelist(rfd *os.File, size int64, slot int) bool {
+	fpos := hd.sectorsize*2 + int64(slot)*hd.flistsize
+	if hd.flistsize <= 0 || fpos+hd.flistsize > size {
+		return false
+	}
+	flblock := make([]byte, hd.flistsize)
+	if _, err := rfd.ReadAt(flblock, fpos); err != nil {
+		return false
+	}
+	return crc32.Checksum(flblock, crctab) == hd.crc
+}
+
+// Verify head sector `data`, decoded from copy `slot`.
+func (hd *Head) verify(data []byte, slot int) bool {
+	n := len(data) - 4
+	hdcrc := binary.LittleEndian.Uint32(data[n:])
+	// index files created before generations were introduced have zero
+	// pick and zero CRC in both copies.
+	if legacy := hd.pick == 0 && hdcrc == 0; !legacy {
+		if hdcrc != crc32.Checksum(data[:n], crctab) || hd.slot() != slot {
+			return false
+		}
 	}
+	return hd.root != 0 && hd.sectorsize == int64(len(data))
+}
 
-	buf := bytes.NewBuffer(data1)
+func (hd *Head) decode(data []byte) {
+	LittleEndian := binary.LittleEndian
+	buf := bytes.NewBuffer(data)
 	if err := binary.Read(buf, LittleEndian, &hd.root); err != nil {
-		panic("Unable to read root from first head sector")
+		panic(fmt.Errorf("%w: unable to read root from head sector", ErrCorrupt))
 	}
 	if err := binary.Read(buf, LittleEndian, &hd.timestamp); err != nil {
-		panic("Unable to read root from first head sector")
+		panic(fmt.Errorf("%w: unable to read timestamp from head sector", ErrCorrupt))
 	}
 	if err := binary.Read(buf, LittleEndian, &hd.sectorsize); err != nil {
-		panic("Unable to read sectorsize from first head sector")
+		panic(fmt.Errorf("%w: unable to read sectorsize from head sector", ErrCorrupt))
 	}
 	if err := binary.Read(buf, LittleEndian, &hd.flistsize); err != nil {
-		panic("Unable to read flistsize from first head sector")
+		panic(fmt.Errorf("%w: unable to read flistsize from head sector", ErrCorrupt))
 	}
 	if err := binary.Read(buf, LittleEndian, &hd.blocksize); err != nil {
-		panic("Unable to read blocksize from first head sector")
+		panic(fmt.Errorf("%w: unable to read blocksize from head sector", ErrCorrupt))
 	}
 	if err := binary.Read(buf, LittleEndian, &hd.maxkeys); err != nil {
-		panic("Unable to read maxkeys from first head sector")
+		panic(fmt.Errorf("%w: unable to read maxkeys from head sector", ErrCorrupt))
 	}
 	if err := binary.Read(buf, LittleEndian, &hd.pick); err != nil {
-		panic("Unable to read pick from first head sector")
+		panic(fmt.Errorf("%w: unable to read pick from head sector", ErrCorrupt))
 	}
 	if err := binary.Read(buf, LittleEndian, &hd.crc); err != nil {
-		panic("Unable to read crc from first head sector")
+		panic(fmt.Errorf("%w: unable to read crc from head sector", ErrCorrupt))
 	}
+	// index files created before `format` was introduced read as zero.
+	if err := binary.Read(buf, LittleEndian, &hd.format); err != nil {
+		panic(fmt.Errorf("%w: unable to read format from head sector", ErrCorrupt))
+	}
+	if err := binary.Read(buf, LittleEndian, &hd.kvformat); err != nil {
+		panic(fmt.Errorf("%w: unable to read kvformat from head sector", ErrCorrupt))
+	}
+	if err := binary.Read(buf, LittleEndian, &hd.kvbase); err != nil {
+		panic(fmt.Errorf("%w: unable to read kvbase from head sector", ErrCorrupt))
+	}
+	// index files created before versioning was introduced read as zero.
+	if err := binary.Read(buf, LittleEndian, &hd.magic); err != nil {
+		panic(fmt.Errorf("%w: unable to read magic from head sector", ErrCorrupt))
+	}
+	if err := binary.Read(buf, LittleEndian, &hd.major); err != nil {
+		panic(fmt.Errorf("%w: unable to read major from head sector", ErrCorrupt))
+	}
+	if err := binary.Read(buf, LittleEndian, &hd.minor); err != nil {
+		panic(fmt.Errorf("%w: unable to read minor from head sector", ErrCorrupt))
+	}
+	if err := binary.Read(buf, LittleEndian, &hd.created); err != nil {
+		panic(fmt.Errorf("%w: unable to read created from head sector", ErrCorrupt))
+	}
+}
 
-	if bytes.Equal(data1, data2) {
-		return false
+// Check magic and version of head read from `idxfile`. Versions older than
+// INDEX_MAJOR are accepted only if they can be upgraded in-place.
+func (hd *Head) checkVersion(idxfile string) error {
+	if hd.magic == 0 && (hd.major != 0 || hd.minor != 0) {
+		return fmt.Errorf("%w: %v, missing magic", ErrFormat, idxfile)
+	} else if hd.magic != 0 && hd.magic != HEAD_MAGIC {
+		return fmt.Errorf("%w: %v, bad magic %x", ErrFormat, idxfile, hd.magic)
+	} else if hd.major > INDEX_MAJOR {
+		return fmt.Errorf(
+			"%w: %v is version %v.%v, supported upto %v.%v",
+			ErrVersion, idxfile, hd.major, hd.minor, INDEX_MAJOR, INDEX_MINOR)
+	}
+	for major := hd.major; major < INDEX_MAJOR; major++ {
+		if upgrades[major] == nil {
+			return fmt.Errorf(
+				"%w: %v is version %v.%v, cannot be upgraded to %v.%v",
+				ErrVersion, idxfile, hd.major, hd.minor, INDEX_MAJOR, INDEX_MINOR)
+		}
 	}
-	return true
+	return nil
 }
 
 // Refer to new root block. When ever an entry / block is updated the entire
@@ -127,12 +246,14 @@ func (hd *Head) setRoot(fpos int64, timestamp int64) *Head {
 	return hd
 }
 
-// flush head-structure to index-file. Updates CRC for freelist.
+// flush head-structure to index-file, as the next generation. Updates CRC
+// for freelist, which must already be flushed into copy `nextSlot()`.
 func (hd *Head) flush(crc uint32) *Head {
 	wfd := hd.wstore.idxWfd
 	LittleEndian := binary.LittleEndian
 
 	hd.crc = crc
+	hd.pick += 1
 
 	buf := bytes.NewBuffer([]byte{})
 	binary.Write(buf, LittleEndian, &hd.root)
@@ -143,12 +264,206 @@ func (hd *Head) flush(crc uint32) *Head {
 	binary.Write(buf, LittleEndian, &hd.maxkeys)
 	binary.Write(buf, LittleEndian, &hd.pick)
 	binary.Write(buf, LittleEndian, &hd.crc)
+	binary.Write(buf, LittleEndian, &hd.format)
+	binary.Write(buf, LittleEndian, &hd.kvformat)
+	binary.Write(buf, LittleEndian, &hd.kvbase)
+	binary.Write(buf, LittleEndian, &hd.magic)
+	binary.Write(buf, LittleEndian, &hd.major)
+	binary.Write(buf, LittleEndian, &hd.minor)
+	binary.Write(buf, LittleEndian, &hd.created)
 
-	valb := buf.Bytes()
-	wfd.WriteAt(valb, hd.fpos_head2) // Write into head sector2
-	wfd.WriteAt(valb, hd.fpos_head1) // Write into head sector1
+	valb := make([]byte, hd.sectorsize) // zero filled
+	copy(valb, buf.Bytes())
+	n := len(valb) - 4
+	LittleEndian.PutUint32(valb[n:], crc32.Checksum(valb[:n], crctab))
+	if _, err := wfd.WriteAt(valb, hd.fposHead(hd.slot())); err != nil {
+		panic(err)
+	}
 
 	hd.dirty = false
 	hd.wstore.flushHeads += 1
 	return hd
 }
+
+// Copy, 0 or 1, of head sector and freelist for this generation.
+func (hd *Head) slot() int {
+	return int(hd.pick % 2)
+}
+
+// Copy, 0 or 1, of head sector and freelist for the next generation.
+func (hd *Head) nextSlot() int {
+	return int((hd.pick + 1) % 2)
+}
+
+func (hd *Head) fposHead(slot int) int64 {
+	if slot == 0 {
+		return hd.fpos_head1
+	}
+	return hd.fpos_head2
+}
+
+// Read index configuration persisted in head sector of `conf.Idxfile`. If
+// `conf.Sectorsize` is zero, sector-size is read from the first head sector.
+func readIndexConfig(conf Config) (ic IndexConfig, err error) {
+	heads, _, pick, err := readHeads(conf.Idxfile, conf.Sectorsize)
+	if err != nil {
+		return ic, err
+	}
+	hd := heads[pick]
+	return IndexConfig{hd.sectorsize, hd.flistsize, hd.blocksize}, nil
+}
+
+// Head sector as read from index-file by ReadHeads(), for tools like fsck.
+type HeadInfo struct {
+	Valid      bool // CRC of head and of its freelist block validate.
+	Root       int64
+	Timestamp  int64
+	Sectorsize int64
+	Flistsize  int64
+	Blocksize  int64
+	Maxkeys    int64
+	Pick       int64
+	CRC        uint32
+	Format     byte
+	KVformat   byte
+	KVbase     int64
+	Magic      uint32
+	Major      uint16
+	Minor      uint16
+	Created    int64
+}
+
+// Read both copies of head sector from `idxfile`, along with the copy that
+// is picked when the index is opened. Error, like ErrFormat or ErrVersion,
+// is returned if the index cannot be opened, heads are returned as far as
+// they could be read.
+func ReadHeads(idxfile string) (infos [2]HeadInfo, pick int, err error) {
+	heads, valid, pick, err := readHeads(idxfile, 0)
+	for slot, hd := range heads {
+		if hd != nil {
+			infos[slot] = HeadInfo{
+				valid[slot], hd.root, hd.timestamp, hd.sectorsize,
+				hd.flistsize, hd.blocksize, hd.maxkeys, hd.pick, hd.crc,
+				hd.format, hd.kvformat, hd.kvbase, hd.magic, hd.major,
+				hd.minor, hd.created,
+			}
+		}
+	}
+	return infos, pick, err
+}
+
+// Freelist as read from index-file by ReadFreelist(), for tools like fsck.
+type FreelistInfo struct {
+	Valid   bool    // CRC of freelist and overflow blocks validate.
+	Offsets []int64 // free blocks, including those listed by overflow blocks.
+	Chain   []int64 // overflow blocks linked from the freelist block.
+}
+
+// Read copy `slot` of freelist block from `idxfile`, described by head
+// `hd`, and follow its chain of overflow blocks. Free blocks are returned as
+// far as they could be read.
+func ReadFreelist(idxfile string, hd HeadInfo, slot int) (info FreelistInfo, err error) {
+	defer catch(&err)
+	conf := Config{Idxfile: idxfile}
+	conf.IndexConfig = IndexConfig{hd.Sectorsize, hd.Flistsize, hd.Blocksize}
+	wstore := &WStore{
+		Config:          conf,
+		fpos_firstblock: conf.Sectorsize*2 + conf.Flistsize*2,
+	}
+	fl := newFreeList(wstore)
+	info.Valid = fl.fetch(slot, hd.CRC)
+	info.Offsets = fl.offsets[:len(fl.offsets)-1] // skip zero-terminator
+	info.Chain = fl.chain
+	return info, nil
+}
+
+// Read and validate both copies of head sector, along with CRC of their
+// freelist blocks, from `idxfile`. Return the decoded copies, whether they
+// validate, and the newest copy that validates. If `sectorsize` is zero, it
+// is read from the first head sector.
+func readHeads(idxfile string, sectorsize int64) (
+	heads [2]*Head, valid [2]bool, pick int, err error) {
+
+	defer catch(&err)
+	rfd, err := os.Open(idxfile)
+	if err != nil {
+		return heads, valid, pick, err
+	}
+	defer rfd.Close()
+
+	// first copy of head is read upfront, for sector-size needed to locate
+	// head sectors, and to identify the file if no copy validates.
+	data := make([]byte, HEAD_SIZE)
+	if _, err := rfd.ReadAt(data, 0); err != nil {
+		err = fmt.Errorf("%w: reading head sector, %v", ErrCorrupt, err)
+		return heads, valid, pick, err
+	}
+	first := &Head{}
+	first.decode(data)
+	// files that are not index-files are reported as such.
+	corrupt := func(err error) error {
+		if verr := first.checkVersion(idxfile); verr != nil {
+			return verr
+		}
+		return err
+	}
+
+	if sectorsize == 0 {
+		sectorsize = first.sectorsize
+	}
+	fi, err := rfd.Stat()
+	if err != nil {
+		return heads, valid, pick, err
+	} else if sectorsize < HEAD_SIZE+4 || sectorsize*2 > fi.Size() {
+		err = fmt.Errorf("%w: invalid sectorsize %v", ErrCorrupt, sectorsize)
+		return heads, valid, pick, corrupt(err)
+	}
+	pick = -1
+	for slot := range heads {
+		data := make([]byte, sectorsize)
+		if _, err := rfd.ReadAt(data, int64(slot)*sectorsize); err != nil {
+			err = fmt.Errorf("%w: reading head sector, %v", ErrCorrupt, err)
+			return heads, valid, 0, err
+		}
+		hd := &Head{}
+		hd.decode(data)
+		heads[slot], valid[slot] = hd, hd.verify(data, slot)
+		if valid[slot] {
+			valid[slot] = hd.verifyFreelist(rfd, fi.Size(), slot)
+		}
+		if valid[slot] && (pick < 0 || hd.pick > heads[pick].pick) {
+			pick = slot
+		}
+	}
+	if pick < 0 {
+		err = fmt.Errorf("%w: no valid head sector", ErrCorrupt)
+		return heads, valid, 0, corrupt(err)
+	} else if err := heads[pick].checkVersion(idxfile); err != nil {
+		return heads, valid, pick, err
+	}
+	return heads, valid, pick, nil
+}
+
+// Merge configured `ic` with index configuration on disk. Zero fields in
+// `ic` are picked from `disk`, other fields must match with `disk`.
+func mergeIndexConfig(ic, disk IndexConfig) (IndexConfig, error) {
+	fields := []struct {
+		name string
+		conf *int64
+		disk int64
+	}{
+		{"sectorsize", &ic.Sectorsize, disk.Sectorsize},
+		{"flistsize", &ic.Flistsize, disk.Flistsize},
+		{"blocksize", &ic.Blocksize, disk.Blocksize},
+	}
+	for _, field := range fields {
+		if *field.conf == 0 {
+			*field.conf = field.disk
+		} else if *field.conf != field.disk {
+			return ic, fmt.Errorf(
+				"%w: %v is %v in index-file, configured %v",
+				ErrConfig, field.name, field.disk, *field.conf)
+		}
+	}
+	return ic, nil
+}
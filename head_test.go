@@ -10,6 +10,11 @@
 package btree
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
 	"testing"
 )
 
@@ -27,3 +32,206 @@ func Test_Head(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_HeadGenerations(t *testing.T) {
+	bt := testBTree(1000)
+	for i := 1000; i < 1100; i++ {
+		bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("value%v", i)})
+	}
+	bt.Drain()
+	if newHead(bt.store.WStore).fetch() == false {
+		t.Fatalf("expected both generations to validate")
+	}
+	bt.store.Close()
+
+	// tear the newest head sector, index opens on the previous generation
+	// and rebuilds the freelist as the next generation.
+	fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	tear := func(slot int64) {
+		data := make([]byte, 1)
+		fd.ReadAt(data, slot*testconf1.Sectorsize+8)
+		data[0] ^= 0xff
+		fd.WriteAt(data, slot*testconf1.Sectorsize+8)
+	}
+	picks := make([]int64, 2)
+	for slot := range picks {
+		data := make([]byte, 8)
+		fd.ReadAt(data, int64(slot)*testconf1.Sectorsize+48)
+		picks[slot] = int64(binary.LittleEndian.Uint64(data))
+	}
+	newest := picks[0]
+	if picks[1] > newest {
+		newest = picks[1]
+	}
+	tear(newest % 2)
+	bt = NewBTree(testStore(false))
+	if pick := bt.store.WStore.head.pick; pick != newest {
+		t.Fatalf("expected generation %v, got %v", newest, pick)
+	} else if c := bt.Count(); c != 1100 {
+		t.Fatalf("expected %v entries, got %v", 1100, c)
+	} else if newHead(bt.store.WStore).fetch() == false {
+		t.Fatalf("expected torn head to be rewritten")
+	} else if bt.store.check() == false {
+		t.Fatalf("expected rebuilt freelist to be consistent")
+	}
+	bt.Check()
+	bt.store.Close()
+
+	tear(0)
+	tear(1)
+	if _, err := OpenStore(testconf1); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	os.Remove(testconf1.Idxfile)
+	os.Remove(testconf1.Kvfile)
+}
+
+func Test_IndexConfig(t *testing.T) {
+	bt := testBTree(100)
+	bt.store.Close()
+
+	// zero index configuration is picked from index-file.
+	conf := testconf1
+	conf.IndexConfig = IndexConfig{}
+	bt = NewBTree(NewStore(conf))
+	if bt.IndexConfig != testconf1.IndexConfig {
+		t.Fatalf("expected %v, got %v", testconf1.IndexConfig, bt.IndexConfig)
+	} else if maxkeys := int64(bt.store.maxKeys()); maxkeys != calculateMaxKeys(testconf1.Blocksize) {
+		t.Fatalf("expected maxkeys %v, got %v", calculateMaxKeys(testconf1.Blocksize), maxkeys)
+	} else if c := bt.Count(); c != 100 {
+		t.Fatalf("expected %v entries, got %v", 100, c)
+	}
+	// conflicting configuration is rejected, even when index is open.
+	conf.Blocksize = testconf1.Blocksize * 2
+	if _, err := OpenStore(conf); !errors.Is(err, ErrConfig) {
+		t.Fatalf("expected ErrConfig, got %v", err)
+	}
+	bt.store.Close()
+	if _, err := OpenStore(conf); !errors.Is(err, ErrConfig) {
+		t.Fatalf("expected ErrConfig, got %v", err)
+	}
+	os.Remove(testconf1.Idxfile)
+	os.Remove(testconf1.Kvfile)
+
+	// new index with zero index configuration is created with defaults.
+	conf.IndexConfig = IndexConfig{}
+	store := NewStore(conf)
+	defer store.Destroy()
+	if ic := (IndexConfig{SECTOR_SIZE, FLIST_SIZE, BLOCK_SIZE}); store.IndexConfig != ic {
+		t.Fatalf("expected %v, got %v", ic, store.IndexConfig)
+	}
+}
+
+func Test_GobMaxKeys(t *testing.T) {
+	limit := calculateMaxKeys_gob(testconf1.Blocksize)
+	for _, maxkeys := range []int64{limit - 10, 0} {
+		store := testStore(true)
+		wstore := store.WStore
+		root := store.FetchNode(wstore.head.root)
+		wstore.head.format = BLOCK_GOB
+		wstore.head.maxkeys = maxkeys
+		wstore.flushNode(root)
+		store.Close()
+
+		store = testStore(false)
+		expected := maxkeys
+		if maxkeys == 0 { // older versions flushed zero maxkeys.
+			expected = limit
+		}
+		if n := int64(store.maxKeys()); n != expected {
+			t.Fatalf("expected maxkeys %v, got %v", expected, n)
+		}
+		store.Destroy()
+	}
+}
+
+func Test_HeadVersion(t *testing.T) {
+	bt := testBTree(100)
+	if hd := bt.store.WStore.head; hd.magic != HEAD_MAGIC {
+		t.Fatalf("expected magic %x, got %x", HEAD_MAGIC, hd.magic)
+	} else if hd.major != INDEX_MAJOR || hd.minor != INDEX_MINOR {
+		t.Fatalf("expected version %v.%v, got %v.%v", INDEX_MAJOR, INDEX_MINOR, hd.major, hd.minor)
+	} else if hd.created == 0 {
+		t.Fatalf("expected creation time")
+	}
+	bt.store.Close()
+
+	// rewrite magic, version and creation time of both copies.
+	fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	rewrite := func(magic uint32, major, minor uint16) {
+		for slot := int64(0); slot < 2; slot++ {
+			data := make([]byte, testconf1.Sectorsize)
+			fd.ReadAt(data, slot*testconf1.Sectorsize)
+			binary.LittleEndian.PutUint32(data[70:], magic)
+			binary.LittleEndian.PutUint16(data[74:], major)
+			binary.LittleEndian.PutUint16(data[76:], minor)
+			binary.LittleEndian.PutUint64(data[78:], 0)
+			n := len(data) - 4
+			binary.LittleEndian.PutUint32(data[n:], crc32.Checksum(data[:n], crctab))
+			fd.WriteAt(data, slot*testconf1.Sectorsize)
+		}
+	}
+
+	rewrite(0x12345678, INDEX_MAJOR, INDEX_MINOR)
+	if _, err := OpenStore(testconf1); !errors.Is(err, ErrFormat) {
+		t.Fatalf("expected ErrFormat, got %v", err)
+	}
+	rewrite(HEAD_MAGIC, INDEX_MAJOR+1, 0)
+	if _, err := OpenStore(testconf1); !errors.Is(err, ErrVersion) {
+		t.Fatalf("expected ErrVersion, got %v", err)
+	}
+
+	// index files created before versioning are upgraded in-place.
+	rewrite(0, 0, 0)
+	bt = NewBTree(testStore(false))
+	if c := bt.Count(); c != 100 {
+		t.Fatalf("expected %v entries, got %v", 100, c)
+	}
+	bt.store.Close()
+	store := testStore(false)
+	defer store.Destroy()
+	if hd := store.WStore.head; hd.magic != HEAD_MAGIC || hd.major != INDEX_MAJOR {
+		t.Fatalf("expected upgraded head, got %x %v.%v", hd.magic, hd.major, hd.minor)
+	} else if hd := newHead(store.WStore); hd.fetch() == false || hd.magic != HEAD_MAGIC {
+		t.Fatalf("expected upgraded head on disk")
+	}
+}
+
+func Test_ReadHeads(t *testing.T) {
+	bt := testBTree(100)
+	bt.store.Close()
+	defer func() {
+		os.Remove(testconf1.Idxfile)
+		os.Remove(testconf1.Kvfile)
+	}()
+	heads, pick, err := ReadHeads(testconf1.Idxfile)
+	if err != nil {
+		t.Fatal(err)
+	} else if !heads[0].Valid || !heads[1].Valid {
+		t.Fatalf("expected both copies to validate")
+	} else if heads[pick].Pick < heads[1-pick].Pick || heads[pick].Magic != HEAD_MAGIC {
+		t.Fatalf("unexpected pick %v, %+v", pick, heads)
+	}
+
+	// zero CRC is accepted only for heads before generations.
+	fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	n := testconf1.Sectorsize - 4
+	fd.WriteAt(make([]byte, 4), int64(pick)*testconf1.Sectorsize+n)
+	if heads, newpick, err := ReadHeads(testconf1.Idxfile); err != nil {
+		t.Fatal(err)
+	} else if heads[pick].Valid || newpick == pick {
+		t.Fatalf("expected head with zero CRC to be invalid")
+	}
+}
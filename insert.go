@@ -10,11 +10,21 @@
 // Index mutation due to {key,docid,value} insert.
 package btree
 
-func (ln *lnode) insert(store *Store, key Key, v Value, mv *MV) (
-	Node, int64, int64) {
+// Insert modes, tells what to do when {key,docid} is already present in the
+// index.
+const (
+	INSERT_UPSERT byte = iota // replace the value of existing entry.
+	INSERT_UNIQUE             // fail the insert with ErrDuplicate.
+)
+
+func (ln *lnode) insert(store *Store, key Key, v Value, mode byte, mv *MV) (
+	Node, int64, int64, bool) {
 
 	index, kfpos, dfpos := ln.searchGE(store, key, true)
-	if kfpos >= 0 && dfpos >= 0 {
+	replaced := kfpos >= 0 && dfpos >= 0
+	if replaced && mode == INSERT_UNIQUE {
+		panic(ErrDuplicate)
+	} else if replaced { // `ln` is already a copy, overwrite in place.
 		ln.ks[index], ln.ds[index] = kfpos, dfpos
 		ln.vs[index] = store.valueOf(v)
 	} else {
@@ -31,28 +41,30 @@ func (ln *lnode) insert(store *Store, key Key, v Value, mv *MV) (
 
 	ln.size = len(ln.ks)
 	if ln.size <= store.maxKeys() {
-		return nil, -1, -1
+		return nil, -1, -1, replaced
 	}
 	spawnKn, mkfpos, mdfpos := ln.split(store)
 	mv.commits[spawnKn.fpos] = spawnKn
-	return spawnKn, mkfpos, mdfpos
+	return spawnKn, mkfpos, mdfpos, replaced
 }
 
-func (in *inode) insert(store *Store, key Key, v Value, mv *MV) (
-	Node, int64, int64) {
+func (in *inode) insert(store *Store, key Key, v Value, mode byte, mv *MV) (
+	Node, int64, int64, bool) {
 
-	index, _, _ := in.searchGE(store, key, true)
-	// Copy on write
-	stalechild := store.FetchMVCache(in.vs[index])
-	child := stalechild.copyOnWrite(store)
-	mv.stales = append(mv.stales, stalechild.getLeafNode().fpos)
-	mv.commits[child.getLeafNode().fpos] = child
+	index, kfpos, dfpos := in.searchGE(store, key, true)
+	// separator is the first entry of its right sub-tree, route an existing
+	// {key,docid} there so that it is replaced instead of duplicated.
+	if kfpos >= 0 && dfpos >= 0 {
+		index += 1
+	}
+	child := store.copyMV(in.vs[index], mv) // Copy on write
 
 	// Recursive insert
-	spawn, mkfpos, mdfpos := child.insert(store, key, v, mv)
+	spawn, mkfpos, mdfpos, replaced := child.insert(store, key, v, mode, mv)
 	in.vs[index] = child.getLeafNode().fpos
+	in.cs[index] = child.count(store)
 	if spawn == nil {
-		return nil, -1, -1
+		return nil, -1, -1, replaced
 	}
 
 	in.ks = in.ks[:len(in.ks)+1]         // Make space in the key array
@@ -65,16 +77,20 @@ func (in *inode) insert(store *Store, key Key, v Value, mv *MV) (
 	copy(in.vs[index+2:], in.vs[index+1:]) // Shift existing data out of the way
 	in.vs[index+1] = spawn.getLeafNode().fpos
 
+	in.cs = in.cs[:len(in.cs)+1]           // Make space in the count array
+	copy(in.cs[index+2:], in.cs[index+1:]) // Shift existing data out of the way
+	in.cs[index+1] = spawn.count(store)
+
 	in.size = len(in.ks)
 	max := store.maxKeys()
 	if in.size <= max {
-		return nil, -1, -1
+		return nil, -1, -1, replaced
 	}
 
 	// this node is full, so we have to split
 	spawnIn, mkfpos, mdfpos := in.split(store)
 	mv.commits[spawnIn.fpos] = spawnIn
-	return spawnIn, mkfpos, mdfpos
+	return spawnIn, mkfpos, mdfpos, replaced
 }
 
 // Split the leaf node into two.
@@ -133,6 +149,8 @@ func (in *inode) split(store *Store) (*inode, int64, int64) {
 
 	copy(newin.vs, in.vs[max/2+1:])
 	in.vs = in.vs[:max/2+1]
+	copy(newin.cs, in.cs[max/2+1:])
+	in.cs = in.cs[:max/2+1]
 	return newin, mkfpos, mdfpos
 }
 
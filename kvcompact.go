@@ -0,0 +1,259 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Garbage collection for kv-file. Entries in kv-file are never removed when
+// index entries are removed or updated. Compaction walks the latest snapshot,
+// copies entries referred by it into a new kv-file and rewrites their
+// file-positions in copy-on-write nodes, all within a single transaction.
+//
+// File-positions of entries in the compacted kv-file are numbered beyond the
+// last entry of the older kv-file, so that older snapshots can continue to
+// read from older kv-file. Compacted kv-file is written from offset zero and
+// file-positions are translated by `kvbase`, the file-position of its first
+// byte, refer kvGen. Compacted kv-file is created as
+// `<kvfile>.compact.<kvbase>` and renamed to kv-file once the head refers to
+// it. Older kv-file is closed after stale nodes of the compacting transaction
+// are recycled, that is, when no reader refers to older snapshots.
+//
+// Every node of the latest snapshot is copied within the compacting
+// transaction, hence compaction holds the entire btree in memory till the
+// snapshot is flushed.
+package btree
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Compaction state, entries are written sequentially into compacted kv-file.
+type kvCompactor struct {
+	wstore *WStore
+	wfd    *os.File
+	w      *bufio.Writer
+	fpos   int64    // file-position of next entry.
+	key    [2]int64 // last key moved, old and new file-position.
+}
+
+// Compact kv-file. Returns the number of bytes dropped from kv-file. Readers
+// continue on their snapshots meanwhile, while writers are blocked.
+//
+// Compacted kv-file replaces kv-file only after the snapshot is flushed, till
+// then CompactKV() cannot be repeated. Older kv-file is removed once readers
+// of older snapshots are done.
+func (bt *BTree) CompactKV() (reclaimed int64, err error) {
+	err = bt.transaction(func(root Node, mv *MV) Node {
+		reclaimed = bt.store.compactKV(root, mv)
+		return root
+	})
+	return reclaimed, err
+}
+
+// Copy entries referred by `root` into compacted kv-file and switch to it.
+func (store *Store) compactKV(root Node, mv *MV) int64 {
+	wstore := store.WStore
+	if wstore.kvpending != "" {
+		panic(fmt.Errorf("previous kv-file compaction is yet to be flushed"))
+	}
+	oldgen := (*kvGen)(atomic.LoadPointer(&wstore.kvgen))
+	size, err := wstore.kvWfd.Seek(0, os.SEEK_END)
+	if err != nil {
+		panic(err)
+	}
+	base := oldgen.base + size
+	tmpfile := kvCompactFile(wstore.Kvfile, base)
+	wfd, err := openWfd(tmpfile, wstore.kvmode()|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		panic(err)
+	}
+	done := false
+	defer func() {
+		if done == false {
+			wfd.Close()
+			os.Remove(tmpfile)
+		}
+	}()
+	kc := &kvCompactor{
+		wstore: wstore,
+		wfd:    wfd,
+		w:      bufio.NewWriterSize(wfd, int(wstore.Blocksize)),
+		fpos:   base,
+		key:    [2]int64{-1, -1},
+	}
+	store.compactNode(root, mv, kc)
+	if err = kc.w.Flush(); err != nil {
+		panic(err)
+	}
+	rfd, err := openRfd(tmpfile)
+	if err != nil {
+		panic(err)
+	}
+
+	// switch to compacted kv-file, older generation is retired along with
+	// the stale nodes of this transaction.
+	gen := &kvGen{base: base, rfd: rfd, prev: oldgen}
+	atomic.StorePointer(&wstore.kvgen, unsafe.Pointer(gen))
+	wstore.kvWfd.Close()
+	wstore.kvWfd = wfd
+	wstore.kvpending = tmpfile
+	reclaimed := size - (kc.fpos - base)
+	wstore.head.kvbase = base
+	mv.kvretire = oldgen
+	done = true
+	return reclaimed
+}
+
+// Rewrite file-positions of entries in `node`, which is already copied, and
+// its sub-tree. Returns the old and new file-positions of key and docid of
+// the first entry in the sub-tree.
+func (store *Store) compactNode(node Node, mv *MV, kc *kvCompactor) (
+	oldk, oldd, newk, newd int64) {
+
+	kn := node.getLeafNode()
+	if node.isLeaf() {
+		if kn.size == 0 {
+			return -1, -1, -1, -1
+		}
+		oldk, oldd = kn.ks[0], kn.ds[0]
+		for i := 0; i < kn.size; i++ {
+			kn.ks[i] = kc.moveKey(kn.ks[i])
+			kn.ds[i] = kc.copy(kn.ds[i], KV_DOCID)
+			kn.vs[i] = kc.copy(kn.vs[i], KV_VALUE)
+		}
+		return oldk, oldd, kn.ks[0], kn.ds[0]
+	}
+	for i, fpos := range kn.vs {
+		child := store.copyMV(fpos, mv)
+		k, d, nk, nd := store.compactNode(child, mv, kc)
+		kn.vs[i] = child.getLeafNode().fpos
+		if i == 0 {
+			oldk, oldd, newk, newd = k, d, nk, nd
+			continue
+		}
+		// separator is the first entry of its right sub-tree, refer
+		// remove(), hence it is already moved.
+		if kn.ks[i-1] == k && kn.ds[i-1] == d {
+			kn.ks[i-1], kn.ds[i-1] = nk, nd
+		} else {
+			kn.ks[i-1] = kc.copy(kn.ks[i-1], KV_KEY)
+			kn.ds[i-1] = kc.copy(kn.ds[i-1], KV_DOCID)
+		}
+	}
+	return oldk, oldd, newk, newd
+}
+
+// Move key at `fpos` to compacted kv-file. Entries of a key with several
+// docids are adjacent and refer to the same key, which is moved only once.
+func (kc *kvCompactor) moveKey(fpos int64) int64 {
+	if fpos != kc.key[0] {
+		kc.key = [2]int64{fpos, kc.copy(fpos, KV_KEY)}
+	}
+	return kc.key[1]
+}
+
+// Copy entry at `fpos` to compacted kv-file.
+func (kc *kvCompactor) copy(fpos int64, typ byte) int64 {
+	rec := kc.wstore.kvRecord(kc.wstore.readKV(fpos, typ), typ)
+	if _, err := kc.w.Write(rec); err != nil {
+		panic(err)
+	}
+	newfpos := kc.fpos
+	kc.fpos += int64(len(rec))
+	return newfpos
+}
+
+// Called after flushing the head that refers to compacted kv-file.
+func (wstore *WStore) renameKV() {
+	if err := os.Rename(wstore.kvpending, wstore.Kvfile); err != nil {
+		panic(err)
+	} else if err := syncDir(wstore.Kvfile); err != nil {
+		panic(err)
+	}
+	wstore.kvpending = ""
+}
+
+// Close kv-file generations starting from `oldgen`, no snapshot refers to
+// them anymore.
+func (wstore *WStore) retireKV(oldgen *kvGen) {
+	gen := (*kvGen)(atomic.LoadPointer(&wstore.kvgen))
+	for ; gen != nil && gen.prev != oldgen; gen = gen.prev {
+	}
+	if gen != nil {
+		gen.prev = nil
+	}
+	for ; oldgen != nil; oldgen = oldgen.prev {
+		oldgen.rfd.Close()
+	}
+}
+
+// Complete or discard compaction interrupted by a crash. Compacted kv-file
+// replaces kv-file only if the flushed head refers to it, that is, its base
+// is head's `kvbase`.
+func (wstore *WStore) recoverKV() error {
+	files, err := kvCompactFiles(wstore.Kvfile)
+	if err != nil {
+		return err
+	}
+	for file, base := range files {
+		if base != wstore.head.kvbase {
+			err = os.Remove(file)
+		} else if err = os.Rename(file, wstore.Kvfile); err == nil {
+			err = syncDir(wstore.Kvfile)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compacted kv-file for `kvfile`, whose first byte is at file-position
+// `base`.
+func kvCompactFile(kvfile string, base int64) string {
+	return fmt.Sprintf("%v.compact.%v", kvfile, base)
+}
+
+// Compacted kv-files left behind for `kvfile`, mapped to their base.
+func kvCompactFiles(kvfile string) (map[string]int64, error) {
+	dir, prefix := filepath.Split(kvfile)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, prefix := make(map[string]int64), prefix+".compact."
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, prefix) == false {
+			continue
+		}
+		base, err := strconv.ParseInt(name[len(prefix):], 10, 64)
+		if err == nil {
+			files[filepath.Join(dir, name)] = base
+		}
+	}
+	return files, nil
+}
+
+// Sync directory of `file`, so that renaming `file` is durable.
+func syncDir(file string) error {
+	fd, err := os.Open(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
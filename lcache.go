@@ -0,0 +1,115 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Bounded cache for leaf nodes, using CLOCK eviction. Leaf nodes are far
+// more in number than intermediate nodes, hence only a working set of them,
+// upto `MaxLeafCache`, is cached.
+//
+// Cached leaves are kept in a ring, and every lookup marks the entry as
+// referenced. When the cache is full, the clock-hand sweeps the ring,
+// clearing the referenced mark, until it finds an entry that was not
+// referenced since the last sweep, which is then replaced by the new leaf.
+// Unlike LRU, lookups don't re-order entries, so they are safe under the
+// read lock of ping-pong cache, refer ppcache.go.
+//
+// Ping-cache and pong-cache are two instances of leafCache, each bounded by
+// `MaxLeafCache`, swapped by ping2Pong().
+package btree
+
+import (
+	"sync/atomic"
+)
+
+type leafCache struct {
+	limit     int
+	index     map[int64]int // fpos -> position in ring
+	ring      []lcEntry
+	hand      int   // clock-hand, position in ring
+	evictions int64 // leaves evicted to make room for new leaves
+}
+
+type lcEntry struct {
+	fpos int64
+	node Node
+	ref  uint32 // referenced since last sweep of clock-hand
+}
+
+// Create a new leaf cache, holding upto `limit` leaf nodes.
+func newLeafCache(limit int) *leafCache {
+	return &leafCache{
+		limit: limit,
+		index: make(map[int64]int),
+		ring:  make([]lcEntry, 0),
+	}
+}
+
+// Lookup leaf node at `fpos`, can be called concurrently with other
+// lookups.
+func (lc *leafCache) get(fpos int64) Node {
+	if i, ok := lc.index[fpos]; ok {
+		e := &lc.ring[i]
+		if atomic.LoadUint32(&e.ref) == 0 {
+			atomic.StoreUint32(&e.ref, 1)
+		}
+		return e.node
+	}
+	return nil
+}
+
+// Cache leaf node at `fpos`, evicting a leaf if the cache is full.
+func (lc *leafCache) put(fpos int64, node Node) {
+	if i, ok := lc.index[fpos]; ok {
+		lc.ring[i].node = node
+		return
+	} else if lc.limit <= 0 {
+		return
+	} else if len(lc.ring) < lc.limit {
+		lc.index[fpos] = len(lc.ring)
+		lc.ring = append(lc.ring, lcEntry{fpos: fpos, node: node})
+		return
+	}
+	for {
+		e := &lc.ring[lc.hand]
+		if atomic.LoadUint32(&e.ref) == 0 {
+			delete(lc.index, e.fpos)
+			lc.index[fpos] = lc.hand
+			*e = lcEntry{fpos: fpos, node: node}
+			atomic.AddInt64(&lc.evictions, 1)
+			lc.hand = (lc.hand + 1) % len(lc.ring)
+			return
+		}
+		atomic.StoreUint32(&e.ref, 0)
+		lc.hand = (lc.hand + 1) % len(lc.ring)
+	}
+}
+
+// Remove leaf node at `fpos`, if cached. Last entry in the ring takes its
+// position.
+func (lc *leafCache) remove(fpos int64) {
+	i, ok := lc.index[fpos]
+	if !ok {
+		return
+	}
+	delete(lc.index, fpos)
+	last := len(lc.ring) - 1
+	if i != last {
+		lc.ring[i] = lc.ring[last]
+		lc.index[lc.ring[i].fpos] = i
+	}
+	lc.ring[last] = lcEntry{}
+	lc.ring = lc.ring[:last]
+	if lc.hand >= len(lc.ring) {
+		lc.hand = 0
+	}
+}
+
+// Number of leaf nodes in cache.
+func (lc *leafCache) size() int {
+	return len(lc.ring)
+}
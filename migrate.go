@@ -0,0 +1,115 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Migrate an index to the latest on-disk format. Index files in older
+// formats, like gob encoded btree blocks, can still be opened and updated
+// in their own format. Migrate() rewrites them into a new pair of index-file
+// and kv-file, bulk loading the new index in sort order.
+//
+// Changes to on-disk format are versioned in head sector, refer head.go.
+// Older versions that can be upgraded in-place, say by updating the head,
+// register a hook in `upgrades`, which are applied when the index is
+// opened. Versions that need the index to be rewritten are rejected with
+// ErrVersion, and shall be rewritten by Migrate() with a version that can
+// still read them.
+package btree
+
+import (
+	"bytes"
+	"log"
+	"os"
+)
+
+// Upgrade hooks, indexed by major version, upgrade the head of an opened
+// index-file to the next major version. Upgraded head is persisted by the
+// next flush.
+var upgrades = map[uint16]func(wstore *WStore){
+	0: upgradeVersion0,
+}
+
+// Index files created before versioning have the same head layout as
+// version 1.0, with zero magic, version and maxkeys. Their blocks are gob
+// encoded without entry counts, and may carry bytes left over from older
+// encodings, they are read in place, refer gobDecode(), and rewritten in
+// binary layout only by Migrate().
+func upgradeVersion0(wstore *WStore) {
+	wstore.head.magic = HEAD_MAGIC
+	wstore.head.major, wstore.head.minor = 1, 0
+}
+
+// Apply upgrade hooks to head fetched from index-file, checkVersion() shall
+// already ensure that hooks are available.
+func (wstore *WStore) upgrade() {
+	hd := wstore.head
+	for hd.major < INDEX_MAJOR {
+		log.Printf("upgrading %v from version %v.%v\n", wstore.Idxfile, hd.major, hd.minor)
+		upgrades[hd.major](wstore)
+	}
+	if hd.minor < INDEX_MINOR {
+		hd.minor = INDEX_MINOR
+	}
+}
+
+// Copy all entries from index described by `from` into a new index
+// described by `to`, which must be empty. Returns the number of entries
+// copied. `from` is left untouched.
+func Migrate(from, to Config) (n int64, err error) {
+	if _, err = os.Stat(from.Idxfile); err != nil {
+		return 0, err
+	}
+	src, err := OpenStore(from)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := OpenStore(to)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	cur := NewBTree(src).Cursor()
+	defer cur.Close()
+	b, err := NewBTree(dst).NewBuilder()
+	if err != nil {
+		return 0, err
+	}
+	var prevkey []byte
+	for cur.Next() {
+		key := cur.Key()
+		samekey := b.count > 0 && bytes.Equal(key, prevkey)
+		if err = b.addBytes(key, cur.Docid(), cur.Value(), samekey); err != nil {
+			return 0, err
+		}
+		prevkey = key
+	}
+	if err = cur.Err(); err != nil {
+		b.Abort()
+		return 0, err
+	}
+	if err = b.Finish(); err != nil {
+		return 0, err
+	}
+	return b.count, nil
+}
+
+// Add next entry from raw bytes, entries are expected in sort order. If
+// `samekey` is true, key of the previous entry is reused.
+func (b *Builder) addBytes(key, docid, value []byte, samekey bool) (err error) {
+	if b.done {
+		return b.closedErr()
+	}
+	defer b.catch(&err)
+	kfpos := b.kfpos
+	if samekey == false {
+		kfpos = b.store.appendKey(key)
+	}
+	b.add(kfpos, b.store.appendDocid(docid), b.store.appendValue(value))
+	return nil
+}
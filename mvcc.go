@@ -22,7 +22,7 @@ const (
 	// messages to mvcc goroutine
 	WS_ACCESS      // {WS_ACCESS} -> timestamp int64
 	WS_RELEASE     // {WS_RELEASE, timestamp} -> minAccess int64
-	WS_SETSNAPSHOT // {WS_SETSNAPSHOT, offsets []int64, root int64, timestamp int64}
+	WS_SETSNAPSHOT // {WS_SETSNAPSHOT, root int64, timestamp int64}
 
 	// messages to defer routine
 	WS_PINGCACHE    // {WS_PINGCACHE, what byte, fpos int64, node Node}
@@ -64,15 +64,24 @@ func (wstore *WStore) release(timestamp int64) int64 {
 	return minAccess
 }
 
-func (wstore *WStore) setSnapShot(offsets []int64, mvroot, mvts int64) {
+// Timestamp of the oldest reader, zero if there are no readers. Stale nodes
+// of snapshots older than this timestamp can be recycled.
+func (wstore *WStore) oldestAccess() int64 {
+	ts, _ := wstore.access(false)
+	return wstore.release(ts)
+}
+
+func (wstore *WStore) setSnapShot(mvroot, mvts int64) {
 	res := make(chan []interface{})
-	wstore.req <- []interface{}{WS_SETSNAPSHOT, offsets, mvroot, mvts, res}
+	wstore.req <- []interface{}{WS_SETSNAPSHOT, mvroot, mvts, res}
 	<-res
 }
 
 func doMVCC(wstore *WStore) {
 	req := wstore.req
-	tscount := wstore.head.timestamp
+	// transactions, including replay of write-ahead log, shall be
+	// timestamped beyond the records loaded from the log.
+	tscount := max(wstore.head.timestamp, wstore.walseq)
 	for {
 		cmd := <-req
 		if cmd == nil {
@@ -99,10 +108,8 @@ func doMVCC(wstore *WStore) {
 			res := cmd[2].(chan []interface{})
 			res <- []interface{}{minAccess}
 		case WS_SETSNAPSHOT: // setSnapShot
-			offsets := cmd[1].([]int64)
-			mvroot, mvts := cmd[2].(int64), cmd[3].(int64)
-			res := cmd[4].(chan []interface{})
-			wstore.freelist.add(offsets)
+			mvroot, mvts := cmd[1].(int64), cmd[2].(int64)
+			res := cmd[3].(chan []interface{})
 			wstore.head.setRoot(mvroot, mvts)
 			wstore.ping2Pong()
 			res <- nil
@@ -33,26 +33,43 @@ type inode struct { // Internal node
 // Node interface that is implemented by both `lnode` and `inode` structure.
 type Node interface {
 	// inserts the {key,docid,valud} typle into index tree, splitting the
-	// nodes as necessary.
+	// nodes as necessary. Insert mode is either INSERT_UPSERT or
+	// INSERT_UNIQUE.
 	//
 	// returns,
 	//  - node, newly spawned node, if the node was split into two.
 	//  - kfpos, median key-position
 	//  - dfpos, median docid-postion
-	insert(*Store, Key, Value, *MV) (Node, int64, int64)
+	//  - whether value of an existing {key,docid} entry was replaced.
+	insert(*Store, Key, Value, byte, *MV) (Node, int64, int64, bool)
 
-	// return number of entries on all the leaf nodes under this Node.
+	// return number of entries on all the leaf nodes under this Node, -1 if
+	// entry counts of the sub-tree are not known, refer FetchNode().
 	count(*Store) int64
 
+	// return number of entries that are less than {key,docid}.
+	rank(*Store, Key) int64
+
+	// return {key,docid,value} tuple for the n-th entry in sort order,
+	// starting from zero.
+	nth(*Store, int64) ([]byte, []byte, []byte)
+
 	// return {key,docid,value} tuple for the lowest key in the tree.
 	front(*Store) ([]byte, []byte, []byte)
 
+	// return {key,docid,value} tuple for the highest key in the tree.
+	back(*Store) ([]byte, []byte, []byte)
+
 	// return true iff this tree contains the `key`.
 	contains(*Store, Key) bool
 
 	// return true iff this tree contains the `key` with specified `docid`
 	equals(*Store, Key) bool
 
+	// return value-position of the entry identified by {key,docid}, -1 if
+	// there is no such entry.
+	get(*Store, Key) int64
+
 	// passes all of the data in this node and its children through the channel
 	// in sort order.
 	traverse(*Store, func(int64, int64, int64))
@@ -60,12 +77,21 @@ type Node interface {
 	// lookup index for key
 	lookup(*Store, Key, Emitter) bool
 
-	// removes the value from the tree, rebalancing as necessary. Returns true
-	// iff an element was actually deleted. Return,
+	// passes {key,docid,value} positions of entries between `low` and `high`
+	// in sort order. Returns false if the scan should not continue, either
+	// because `high` was crossed or the callback returned false.
+	rangeScan(*Store, Key, Key, byte, func(int64, int64, int64) bool) bool
+
+	// same as rangeScan() but passes entries in descending sort order,
+	// starting from `high` down to `low`.
+	rangeScanDesc(*Store, Key, Key, byte, func(int64, int64, int64) bool) bool
+
+	// removes the value from the tree, rebalancing as necessary. Return,
 	//  - Node
 	//  - whether to rebalance or not.
-	//  - slice of stalenodes
-	remove(*Store, Key, *MV) (Node, bool, int64, int64)
+	//  - kfpos, dfpos of the new separator, if first entry was removed.
+	//  - true iff an element was actually deleted.
+	remove(*Store, Key, *MV) (Node, bool, int64, int64, bool)
 
 	//---- Support methods.
 	isLeaf() bool        // Return whether node is a leaf node or not.
@@ -231,19 +257,83 @@ func (ln *lnode) count(store *Store) int64 {
 
 func (in *inode) count(store *Store) int64 {
 	n := int64(0)
-	for _, v := range in.vs {
-		n += store.FetchNCache(v).count(store)
+	for _, c := range in.cs {
+		if c < 0 {
+			return -1
+		}
+		n += c
 	}
 	return n
 }
 
+// Number of entries under this Node, entry counts that are not known are
+// computed by walking down the sub-tree.
+func (in *inode) total(store *Store) int64 {
+	n := int64(0)
+	for i := range in.cs {
+		n += in.countOf(store, i)
+	}
+	return n
+}
+
+// Number of entries under the i-th child.
+func (in *inode) countOf(store *Store, i int) int64 {
+	if in.cs[i] >= 0 {
+		return in.cs[i]
+	}
+	child := store.FetchNCache(in.vs[i])
+	if n := child.count(store); n >= 0 {
+		return n
+	}
+	return child.(*inode).total(store)
+}
+
+//---- rank
+func (ln *lnode) rank(store *Store, key Key) int64 {
+	index, _, _ := ln.searchGE(store, key, true)
+	return int64(index)
+}
+
+func (in *inode) rank(store *Store, key Key) int64 {
+	index, kfpos, dfpos := in.searchGE(store, key, true)
+	if kfpos >= 0 && dfpos >= 0 { // separator is the first entry of right
+		index += 1
+	}
+	n := int64(0)
+	for i := 0; i < index; i++ {
+		n += in.countOf(store, i)
+	}
+	return n + store.FetchNCache(in.vs[index]).rank(store, key)
+}
+
+//---- nth
+func (ln *lnode) nth(store *Store, n int64) ([]byte, []byte, []byte) {
+	if n < 0 || n >= int64(ln.size) {
+		return nil, nil, nil
+	}
+	return store.fetchKey(ln.ks[n]),
+		store.fetchDocid(ln.ds[n]),
+		store.fetchValue(ln.vs[n])
+}
+
+func (in *inode) nth(store *Store, n int64) ([]byte, []byte, []byte) {
+	for i := range in.cs {
+		c := in.countOf(store, i)
+		if n < c {
+			return store.FetchNCache(in.vs[i]).nth(store, n)
+		}
+		n -= c
+	}
+	return nil, nil, nil
+}
+
 //---- front
 func (ln *lnode) front(store *Store) ([]byte, []byte, []byte) {
 	if ln.size == 0 {
 		return nil, nil, nil
 	} else {
-		return store.fetchValue(ln.ks[0]),
-			store.fetchValue(ln.ds[0]),
+		return store.fetchKey(ln.ks[0]),
+			store.fetchDocid(ln.ds[0]),
 			store.fetchValue(ln.vs[0])
 	}
 }
@@ -252,6 +342,21 @@ func (in *inode) front(store *Store) ([]byte, []byte, []byte) {
 	return store.FetchNCache(in.vs[0]).front(store)
 }
 
+//---- back
+func (ln *lnode) back(store *Store) ([]byte, []byte, []byte) {
+	if ln.size == 0 {
+		return nil, nil, nil
+	}
+	i := ln.size - 1
+	return store.fetchKey(ln.ks[i]),
+		store.fetchDocid(ln.ds[i]),
+		store.fetchValue(ln.vs[i])
+}
+
+func (in *inode) back(store *Store) ([]byte, []byte, []byte) {
+	return store.FetchNCache(in.vs[in.size]).back(store)
+}
+
 //---- contains
 func (ln *lnode) contains(store *Store, key Key) bool {
 	_, kfpos, _ := ln.searchGE(store, key, false)
@@ -280,6 +385,23 @@ func (in *inode) equals(store *Store, key Key) bool {
 	return store.FetchNCache(in.vs[idx]).equals(store, key)
 }
 
+//---- get
+func (ln *lnode) get(store *Store, key Key) int64 {
+	index, kfpos, dfpos := ln.searchGE(store, key, true)
+	if (kfpos >= 0) && (dfpos >= 0) {
+		return ln.vs[index]
+	}
+	return -1
+}
+
+func (in *inode) get(store *Store, key Key) int64 {
+	index, kfpos, dfpos := in.searchGE(store, key, true)
+	if (kfpos >= 0) && (dfpos >= 0) { // separator is the first entry of right
+		index += 1
+	}
+	return store.FetchNCache(in.vs[index]).get(store, key)
+}
+
 //-- traverse
 func (ln *lnode) traverse(store *Store, fun func(int64, int64, int64)) {
 	for i := range ln.ks {
@@ -328,6 +450,127 @@ func (in *inode) lookup(store *Store, key Key, emit Emitter) bool {
 	return true
 }
 
+//---- range
+func (ln *lnode) rangeScan(store *Store, low, high Key, incl byte,
+	fun func(int64, int64, int64) bool) bool {
+
+	index := 0
+	if low != nil {
+		var kfpos, dfpos int64
+		index, kfpos, dfpos = ln.searchGE(store, low, true)
+		if kfpos >= 0 && dfpos >= 0 && (incl&RANGE_LOW) == 0 {
+			index += 1
+		}
+	}
+	for i := index; i < ln.size; i++ {
+		if high != nil {
+			cmp, _, _ := high.CompareLess(store, ln.ks[i], ln.ds[i], true)
+			if cmp < 0 || (cmp == 0 && (incl&RANGE_HIGH) == 0) {
+				return false
+			}
+		}
+		if fun(ln.ks[i], ln.ds[i], ln.vs[i]) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (in *inode) rangeScan(store *Store, low, high Key, incl byte,
+	fun func(int64, int64, int64) bool) bool {
+
+	index := 0
+	if low != nil {
+		var kfpos, dfpos int64
+		index, kfpos, dfpos = in.searchGE(store, low, true)
+		if kfpos >= 0 && dfpos >= 0 { // separator is the first entry of right
+			index += 1
+		}
+	}
+	for i := index; i < in.size+1; i++ {
+		if store.FetchNCache(in.vs[i]).rangeScan(store, low, high, incl, fun) == false {
+			return false
+		}
+		low = nil // rest of the children are greater than `low`
+	}
+	return true
+}
+
+func (ln *lnode) rangeScanDesc(store *Store, low, high Key, incl byte,
+	fun func(int64, int64, int64) bool) bool {
+
+	index := ln.size - 1
+	if high != nil {
+		var kfpos, dfpos int64
+		index, kfpos, dfpos = ln.searchGE(store, high, true)
+		if kfpos < 0 || dfpos < 0 || (incl&RANGE_HIGH) == 0 {
+			index -= 1
+		}
+	}
+	for i := index; i >= 0; i-- {
+		if low != nil {
+			cmp, _, _ := low.CompareLess(store, ln.ks[i], ln.ds[i], true)
+			if cmp > 0 || (cmp == 0 && (incl&RANGE_LOW) == 0) {
+				return false
+			}
+		}
+		if fun(ln.ks[i], ln.ds[i], ln.vs[i]) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (in *inode) rangeScanDesc(store *Store, low, high Key, incl byte,
+	fun func(int64, int64, int64) bool) bool {
+
+	index := in.size
+	if high != nil {
+		var kfpos, dfpos int64
+		index, kfpos, dfpos = in.searchGE(store, high, true)
+		if kfpos >= 0 && dfpos >= 0 { // separator is the first entry of right
+			index += 1
+		}
+	}
+	for i := index; i >= 0; i-- {
+		if store.FetchNCache(in.vs[i]).rangeScanDesc(store, low, high, incl, fun) == false {
+			return false
+		}
+		high = nil // rest of the children are less than `high`
+	}
+	return true
+}
+
+//---- prefix
+// Key that sorts before all the keys starting with `prefix`, key-bytes are
+// compared byte-wise. Refer Cursor.SeekPrefix().
+type prefixKey struct {
+	prefix []byte
+}
+
+func (k *prefixKey) Bytes() []byte {
+	return k.prefix
+}
+
+func (k *prefixKey) Docid() []byte {
+	return nil
+}
+
+func (k *prefixKey) CompareLess(s *Store, kfpos, dfpos int64, isD bool) (
+	int, int64, int64) {
+
+	if cmp := bytes.Compare(k.prefix, s.fetchKey(kfpos)); cmp != 0 {
+		return cmp, -1, -1
+	} else if isD {
+		return -1, kfpos, -1
+	}
+	return 0, kfpos, -1
+}
+
+func (k *prefixKey) Equal(otherk []byte, otherd []byte) (bool, bool) {
+	return bytes.Equal(k.prefix, otherk), false
+}
+
 // Convinience method
 func (ln *lnode) show(store *Store, level int) {
 	prefix := ""
@@ -344,7 +587,7 @@ func (ln *lnode) show(store *Store, level int) {
 			"%v%v key:%v docid:%v\n",
 			prefix+"  ", i,
 			string(store.fetchKey(ln.ks[i])),
-			string(store.fetchKey(ln.ds[i])),
+			string(store.fetchDocid(ln.ds[i])),
 		)
 	}
 	fmt.Printf("%vkeys: %v\n", prefix+"  ", ln.ks)
@@ -371,7 +614,7 @@ func (ln *lnode) showKeys(store *Store, level int) {
 	}
 	for i := range ln.ks {
 		keyb := store.fetchKey(ln.ks[i])
-		docb := store.fetchKey(ln.ds[i])
+		docb := store.fetchDocid(ln.ds[i])
 		fmt.Println(prefix, string(keyb), " ; ", string(docb))
 	}
 }
@@ -384,7 +627,7 @@ func (in *inode) showKeys(store *Store, level int) {
 	for i := range in.ks {
 		store.FetchNCache(in.vs[i]).showKeys(store, level+1)
 		keyb := store.fetchKey(in.ks[i])
-		docb := store.fetchKey(in.ds[i])
+		docb := store.fetchDocid(in.ds[i])
 		fmt.Println(prefix, "*", string(keyb), " ; ", string(docb))
 	}
 	store.FetchNCache(in.vs[in.size]).showKeys(store, level+1)
@@ -406,7 +649,10 @@ func (ln *lnode) check(store *Store, c *CheckContext) {
 func (in *inode) check(store *Store, c *CheckContext) {
 	c.nodepath = append(c.nodepath, in.fpos)
 	in.getLeafNode().checkKeys(store, c)
-	for _, v := range in.vs {
+	if len(in.cs) != len(in.vs) {
+		log.Panicln("Check: number of entry counts does not match values")
+	}
+	for i, v := range in.vs {
 		if v == 0 {
 			log.Panicln("Check: value fpos in intermediate node cannot be zero")
 		}
@@ -415,7 +661,11 @@ func (in *inode) check(store *Store, c *CheckContext) {
 				log.Panicln("Check: child node is also in freelist", offset)
 			}
 		}
-		store.FetchNCache(v).check(store, c)
+		child := store.FetchNCache(v)
+		child.check(store, c)
+		if in.cs[i] >= 0 && in.cs[i] != child.count(store) {
+			log.Panicln("Check: mismatch in entry count", in.cs[i], child.count(store))
+		}
 	}
 	c.nodepath = c.nodepath[:len(c.nodepath)-1]
 }
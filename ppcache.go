@@ -48,7 +48,6 @@ package btree
 
 import (
 	"log"
-	"os"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -75,8 +74,8 @@ func (wstore *WStore) ncacheLookup(fpos int64) Node {
 	var node Node
 	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncpong))
 	if node = (*nc)[fpos]; node == nil {
-		lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcpong))
-		if node = (*lc)[fpos]; node != nil {
+		lc := (*leafCache)(atomic.LoadPointer(&wstore.lcpong))
+		if node = lc.get(fpos); node != nil {
 			wstore.lcHits += 1
 		}
 	} else {
@@ -91,11 +90,10 @@ func (wstore *WStore) ncache(node Node) {
 
 	fpos := node.getLeafNode().fpos
 	if node.isLeaf() {
-		lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcpong))
-		if len(*lc) < wstore.MaxLeafCache {
-			(*lc)[fpos] = node
-		}
-		wstore.maxlenLC = max(wstore.maxlenLC, int64(len(*lc)))
+		lc := (*leafCache)(atomic.LoadPointer(&wstore.lcpong))
+		lc.put(fpos, node)
+		wstore.lcMisses += 1
+		wstore.maxlenLC = max(wstore.maxlenLC, int64(lc.size()))
 	} else {
 		nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncpong))
 		(*nc)[fpos] = node
@@ -108,18 +106,18 @@ func (wstore *WStore) ncacheEvict(fposs []int64) {
 	defer wstore.Unlock()
 
 	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncpong))
-	lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcpong))
+	lc := (*leafCache)(atomic.LoadPointer(&wstore.lcpong))
 	for _, fpos := range fposs {
 		delete(*nc, fpos)
-		delete(*lc, fpos)
+		lc.remove(fpos)
 	}
 }
 
 func (wstore *WStore) _pingCache(fpos int64, node Node) {
 	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-	lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
+	lc := (*leafCache)(atomic.LoadPointer(&wstore.lcping))
 	if node.isLeaf() {
-		(*lc)[fpos] = node
+		lc.put(fpos, node)
 	} else {
 		(*nc)[fpos] = node
 	}
@@ -127,9 +125,9 @@ func (wstore *WStore) _pingCache(fpos int64, node Node) {
 
 func (wstore *WStore) _pingCacheEvict(fpos int64) {
 	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-	lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
+	lc := (*leafCache)(atomic.LoadPointer(&wstore.lcping))
 	delete(*nc, fpos)
-	delete(*lc, fpos)
+	lc.remove(fpos)
 }
 
 func (wstore *WStore) cacheKey(fpos int64, key []byte) {
@@ -140,11 +138,11 @@ func (wstore *WStore) cacheDocid(fpos int64, docid []byte) {
 	wstore.pingDocid(DEFER_ADD, fpos, docid)
 }
 
-func (wstore *WStore) lookupKey(rfd *os.File, fpos int64) []byte {
+func (wstore *WStore) lookupKey(fpos int64) []byte {
 	var key []byte
 	kdpong := (*map[int64][]byte)(atomic.LoadPointer(&wstore.kdpong))
 	if key = (*kdpong)[fpos]; key == nil {
-		key = wstore.readKV(rfd, fpos)
+		key = wstore.readKV(fpos, KV_KEY)
 		if key != nil {
 			wstore.cacheKey(fpos, key)
 		}
@@ -154,11 +152,11 @@ func (wstore *WStore) lookupKey(rfd *os.File, fpos int64) []byte {
 	return key
 }
 
-func (wstore *WStore) lookupDocid(rfd *os.File, fpos int64) []byte {
+func (wstore *WStore) lookupDocid(fpos int64) []byte {
 	var docid []byte
 	kdpong := (*map[int64][]byte)(atomic.LoadPointer(&wstore.kdpong))
 	if docid = (*kdpong)[fpos]; docid == nil {
-		docid = wstore.readKV(rfd, fpos)
+		docid = wstore.readKV(fpos, KV_DOCID)
 		if docid != nil {
 			wstore.cacheDocid(fpos, docid)
 		}
@@ -171,12 +169,12 @@ func (wstore *WStore) lookupDocid(rfd *os.File, fpos int64) []byte {
 func (wstore *WStore) assertNotMemberCache(offsets []int64) {
 	if wstore.Debug {
 		nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-		lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
+		lc := (*leafCache)(atomic.LoadPointer(&wstore.lcping))
 		for _, fpos := range offsets {
 			if (*nc)[fpos] != nil {
 				log.Panicln("to be freed fpos is in ncping-cache", fpos)
-			} else if (*lc)[fpos] != nil {
-				log.Panicln("to be freed fpos is in ncping-cache", fpos)
+			} else if _, ok := lc.index[fpos]; ok {
+				log.Panicln("to be freed fpos is in lcping-cache", fpos)
 			}
 		}
 	}
@@ -205,20 +203,20 @@ func (wstore *WStore) ping2Pong() {
 	wstore.pingpongChCnt += 1
 	defer wstore.Unlock()
 
-	// Trim leaf cache
-	lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
+	// Leaf caches are bounded by MaxLeafCache, refer lcache.go
+	lc := (*leafCache)(atomic.LoadPointer(&wstore.lcping))
 	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-	wstore.maxlenLC = max(wstore.maxlenLC, int64(len(*lc)))
+	wstore.maxlenLC = max(wstore.maxlenLC, int64(lc.size()))
 	wstore.maxlenNC = max(wstore.maxlenNC, int64(len(*nc)))
-	if len(*lc) > wstore.MaxLeafCache {
-		i := len(*lc)
-		for x := range *lc {
-			if i < wstore.MaxLeafCache {
-				break
-			}
-			delete(*lc, x)
-		}
-	}
+}
+
+// Number of leaf nodes evicted from ping-cache and pong-cache.
+func (wstore *WStore) lcEvictions() int64 {
+	wstore.RLock()
+	defer wstore.RUnlock()
+	lcping := (*leafCache)(atomic.LoadPointer(&wstore.lcping))
+	lcpong := (*leafCache)(atomic.LoadPointer(&wstore.lcpong))
+	return atomic.LoadInt64(&lcping.evictions) + atomic.LoadInt64(&lcpong.evictions)
 }
 
 func (wstore *WStore) displayPing() {
@@ -228,9 +226,9 @@ func (wstore *WStore) displayPing() {
 		fposs = append(fposs, fpos)
 	}
 
-	lcping := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
+	lcping := (*leafCache)(atomic.LoadPointer(&wstore.lcping))
 	fposs = make([]int64, 0, 100)
-	for fpos, _ := range *lcping {
+	for fpos, _ := range lcping.index {
 		fposs = append(fposs, fpos)
 	}
 }
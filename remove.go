@@ -9,15 +9,19 @@
 
 package btree
 
+import (
+	"bytes"
+)
+
 // Return the mutated node along with a boolean that says whether a rebalance
 // is required or not.
 func (ln *lnode) remove(store *Store, key Key, mv *MV) (
-	Node, bool, int64, int64) {
+	Node, bool, int64, int64, bool) {
 
 	index, equal := ln.searchEqual(store, key)
 	mk, md := int64(-1), int64(-1)
 	if equal == false {
-		return ln, false, mk, md
+		return ln, false, mk, md, false
 	}
 
 	copy(ln.ks[index:], ln.ks[index+1:])
@@ -41,26 +45,21 @@ func (ln *lnode) remove(store *Store, key Key, mv *MV) (
 	}
 
 	if ln.size >= store.RebalanceThrs {
-		return ln, false, mk, md
+		return ln, false, mk, md, true
 	}
-	return ln, true, mk, md
+	return ln, true, mk, md, true
 }
 
 // Return the mutated node along with a boolean that says whether a rebalance
 // is required or not.
 func (in *inode) remove(store *Store, key Key, mv *MV) (
-	Node, bool, int64, int64) {
+	Node, bool, int64, int64, bool) {
 
 	index, equal := in.searchEqual(store, key)
-
-	// Copy on write
-	stalechild := store.FetchMVCache(in.vs[index])
-	child := stalechild.copyOnWrite(store)
-	mv.stales = append(mv.stales, stalechild.getLeafNode().fpos)
-	mv.commits[child.getLeafNode().fpos] = child
+	child := store.copyMV(in.vs[index], mv) // Copy on write
 
 	// Recursive remove
-	child, rebalnc, mk, md := child.remove(store, key, mv)
+	child, rebalnc, mk, md, removed := child.remove(store, key, mv)
 	if equal {
 		if mk < 0 || md < 0 {
 			panic("separator cannot be less than zero")
@@ -71,9 +70,10 @@ func (in *inode) remove(store *Store, key Key, mv *MV) (
 		in.ks[index-1], in.ds[index-1] = mk, md
 	}
 	in.vs[index] = child.getLeafNode().fpos
+	in.cs[index] = child.count(store)
 
 	if rebalnc == false {
-		return in, false, mk, md
+		return in, false, mk, md, removed
 	}
 
 	var node Node = in
@@ -84,26 +84,26 @@ func (in *inode) remove(store *Store, key Key, mv *MV) (
 
 	// Try to rebalance from left, if there is a left node available.
 	if rebalnc && (index > 0) {
-		left := store.FetchMVCache(in.vs[index-1])
+		left := store.fetchMV(in.vs[index-1], mv)
 		if canRebalance(child, left) {
 			node, index = in.rebalanceLeft(store, index, child, left, mv)
 		}
 	}
 	// Try to rebalance from right, if there is a right node available.
 	if rebalnc && (index >= 0) && (index+1 <= in.size) {
-		right := store.FetchMVCache(in.vs[index+1])
+		right := store.fetchMV(in.vs[index+1], mv)
 		if canRebalance(child, right) {
 			node, index = in.rebalanceRight(store, index, child, right, mv)
 		}
 	}
 
-	// There is one corner case, where node is not `in` but `child` but in is
-	// in mv.commits and flushed into the disk, but actually orphaned.
+	// When btree-level gets reduced, node is not `in` but `child`, and `in`
+	// is dropped from mv.commits as stale.
 
 	if node.getLeafNode().size >= store.RebalanceThrs {
-		return node, false, mk, md
+		return node, false, mk, md, removed
 	}
-	return node, true, mk, md
+	return node, true, mk, md, removed
 }
 
 func (in *inode) rebalanceLeft(store *Store, index int, child Node, left Node, mv *MV) (
@@ -114,9 +114,9 @@ func (in *inode) rebalanceLeft(store *Store, index int, child Node, left Node, m
 	mk, md := in.ks[index-1], in.ds[index-1]
 	if count == 0 { // We can merge with left child
 		_, stalenodes := left.mergeRight(store, child, mk, md)
-		mv.stales = append(mv.stales, stalenodes...)
+		mv.stale(stalenodes...)
 		if in.size == 1 { // This is where btree-level gets reduced. crazy eh!
-			mv.stales = append(mv.stales, in.fpos)
+			mv.stale(in.fpos)
 			return child, -1
 		} else {
 			// The median aka seperator has to go
@@ -128,14 +128,16 @@ func (in *inode) rebalanceLeft(store *Store, index int, child Node, left Node, m
 			// left-child has to go
 			copy(in.vs[index-1:], in.vs[index:])
 			in.vs = in.vs[:len(in.ks)+1]
+			copy(in.cs[index-1:], in.cs[index:])
+			in.cs = in.cs[:len(in.ks)+1]
+			in.cs[index-1] = child.count(store)
 			return in, (index - 1)
 		}
 	} else {
-		mv.stales = append(mv.stales, left.getLeafNode().fpos)
-		left := left.copyOnWrite(store)
-		mv.commits[left.getLeafNode().fpos] = left
+		left := store.copyMV(left.getLeafNode().fpos, mv)
 		in.ks[index-1], in.ds[index-1] = left.rotateRight(store, child, count, mk, md)
 		in.vs[index-1] = left.getLeafNode().fpos
+		in.cs[index-1], in.cs[index] = left.count(store), child.count(store)
 		return in, index
 	}
 }
@@ -148,9 +150,9 @@ func (in *inode) rebalanceRight(store *Store, index int, child Node, right Node,
 	mk, md := in.ks[index], in.ds[index]
 	if count == 0 {
 		_, stalenodes := child.mergeLeft(store, right, mk, md)
-		mv.stales = append(mv.stales, stalenodes...)
+		mv.stale(stalenodes...)
 		if in.size == 1 { // There is where btree-level gets reduced. crazy eh!
-			mv.stales = append(mv.stales, in.fpos)
+			mv.stale(in.fpos)
 			return child, -1
 		} else {
 			// The median aka separator has to go
@@ -162,14 +164,16 @@ func (in *inode) rebalanceRight(store *Store, index int, child Node, right Node,
 			// right child has to go
 			copy(in.vs[index+1:], in.vs[index+2:])
 			in.vs = in.vs[:len(in.ks)+1]
+			copy(in.cs[index+1:], in.cs[index+2:])
+			in.cs = in.cs[:len(in.ks)+1]
+			in.cs[index] = child.count(store)
 			return in, index
 		}
 	} else {
-		mv.stales = append(mv.stales, right.getLeafNode().fpos)
-		right := right.copyOnWrite(store)
-		mv.commits[right.getLeafNode().fpos] = right
+		right := store.copyMV(right.getLeafNode().fpos, mv)
 		in.ks[index], in.ds[index] = child.rotateLeft(store, right, count, mk, md)
 		in.vs[index+1] = right.getLeafNode().fpos
+		in.cs[index], in.cs[index+1] = child.count(store), right.count(store)
 		return in, index
 	}
 }
@@ -342,6 +346,9 @@ func (in *inode) mergeRight(store *Store, othern Node, mk, md int64) (
 	other.vs = other.vs[:in.size+other.size+2]
 	copy(other.vs[in.size+1:], other.vs)
 	copy(other.vs[:in.size+1], in.vs)
+	other.cs = other.cs[:in.size+other.size+2]
+	copy(other.cs[in.size+1:], other.cs)
+	copy(other.cs[:in.size+1], in.cs)
 	other.size = len(other.ks)
 
 	store.WStore.countMergeRight += 1
@@ -375,6 +382,11 @@ func (in *inode) rotateRight(store *Store, n Node, count int, mk, md int64) (
 	copy(child.vs[count:], child.vs[:chlen+1])
 	copy(child.vs[:count], in.vs[len(in.vs)-count:])
 	in.vs = in.vs[:len(in.vs)-count]
+	// Move last count entry-counts from left -> child
+	child.cs = child.cs[:chlen+count+1] // First expand
+	copy(child.cs[count:], child.cs[:chlen+1])
+	copy(child.cs[:count], in.cs[len(in.cs)-count:])
+	in.cs = in.cs[:len(in.cs)-count]
 	// Pop out median
 	mk, md = in.ks[in.size-1], in.ds[in.size-1]
 	in.ks = in.ks[:in.size-1]
@@ -404,6 +416,8 @@ func (in *inode) mergeLeft(store *Store, othern Node, mk, md int64) (
 
 	in.vs = in.vs[:in.size+other.size+2]
 	copy(in.vs[in.size+1:], other.vs[:other.size+1])
+	in.cs = in.cs[:in.size+other.size+2]
+	copy(in.cs[in.size+1:], other.cs[:other.size+1])
 	in.size = len(in.ks)
 
 	store.WStore.countMergeLeft += 1
@@ -439,6 +453,11 @@ func (in *inode) rotateLeft(store *Store, n Node, count int, mk, md int64) (
 	// Don't blinldy shrink right values
 	copy(right.vs, right.vs[count:])
 	right.vs = right.vs[:rlen-count+1]
+	// Move first count entry-counts from right -> child
+	in.cs = in.cs[:chlen+count] // First expand
+	copy(in.cs[chlen:], right.cs[:count])
+	copy(right.cs, right.cs[count:])
+	right.cs = right.cs[:rlen-count+1]
 
 	// Pop out median
 	mk, md = in.ks[in.size-1], in.ds[in.size-1]
@@ -463,3 +482,78 @@ func canRebalance(n Node, m Node) bool {
 	}
 	return rc
 }
+
+// Return docid-position of the first entry matching `key`, ignoring key's
+// docid, in the tree under transaction `mv`. Returns -1 if there is no such
+// entry.
+func (store *Store) firstDocid(root Node, key Key, mv *MV) int64 {
+	minkey := &minDocidKey{Key: key}
+	kfpos, dfpos := int64(-1), int64(-1) // nearest entry on the right
+	node := root
+	for node.isLeaf() == false {
+		in := node.getLeafNode()
+		index, _, _ := in.searchGE(store, minkey, true)
+		if index < in.size { // separator is the first entry of right
+			kfpos, dfpos = in.ks[index], in.ds[index]
+		}
+		node = store.fetchMV(in.vs[index], mv)
+	}
+	ln := node.getLeafNode()
+	index, _, _ := ln.searchGE(store, minkey, true)
+	if index < ln.size {
+		kfpos, dfpos = ln.ks[index], ln.ds[index]
+	}
+	if kfpos < 0 {
+		return -1
+	} else if cmp, _, _ := key.CompareLess(store, kfpos, dfpos, false); cmp != 0 {
+		return -1
+	}
+	return dfpos
+}
+
+// Key that sorts before all the docids of wrapped `Key`.
+type minDocidKey struct {
+	Key
+}
+
+func (k *minDocidKey) CompareLess(s *Store, kfpos, dfpos int64, isD bool) (
+	int, int64, int64) {
+
+	cmp, kfpos, _ := k.Key.CompareLess(s, kfpos, dfpos, false)
+	if cmp == 0 && isD {
+		return -1, kfpos, -1
+	}
+	return cmp, kfpos, -1
+}
+
+// Key that is identified by wrapped `Key` and the entry whose docid is at
+// `dfpos`, which must be the first docid of `Key`, refer firstDocid(). Hence
+// other entries of `Key` sort after it, irrespective of how `Key` orders its
+// docids.
+type docidKey struct {
+	Key
+	dfpos int64
+	docid []byte
+}
+
+func (k *docidKey) Docid() []byte {
+	return k.docid
+}
+
+func (k *docidKey) CompareLess(s *Store, kfpos, dfpos int64, isD bool) (
+	int, int64, int64) {
+
+	cmp, kfpos, _ := k.Key.CompareLess(s, kfpos, dfpos, false)
+	if cmp == 0 && isD {
+		if dfpos == k.dfpos {
+			return 0, kfpos, dfpos
+		}
+		return -1, kfpos, -1
+	}
+	return cmp, kfpos, -1
+}
+
+func (k *docidKey) Equal(otherk []byte, otherd []byte) (bool, bool) {
+	keyeq, _ := k.Key.Equal(otherk, nil)
+	return keyeq, otherd != nil && bytes.Equal(k.docid, otherd)
+}
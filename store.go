@@ -28,6 +28,8 @@
 package btree
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
 )
@@ -43,30 +45,52 @@ const (
 type Store struct {
 	//Config
 	*WStore  // Reference to write-store.
-	kvRfd  *os.File // Random read-only access for kv-file.
 	idxRfd *os.File // Random read-only access for index-file.
 }
 
 //---- functions and receivers
 
-// Construct a new `Store` object.
+// Construct a new `Store` object, panics on failure. Refer OpenStore().
 func NewStore(conf Config) *Store {
-	wstore := OpenWStore(conf)
+	store, err := OpenStore(conf)
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+// Open a new `Store` object on index-file and kv-file, files are created if
+// they are not already present.
+func OpenStore(conf Config) (*Store, error) {
+	wstore, err := OpenWStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	idxRfd, err := openRfd(conf.Idxfile)
+	if err != nil {
+		wstore.CloseWStore()
+		return nil, err
+	}
 	store := &Store{
 		//Config: conf,
 		WStore: wstore,
-		idxRfd: openRfd(conf.Idxfile),
-		kvRfd:  openRfd(conf.Kvfile),
+		idxRfd: idxRfd,
 	}
-	// TODO : Check whether index file is sane, both configuration and
-	// freelist.
-	return store
+	if err := store.checkOpen(); err != nil {
+		store.Close()
+		return nil, err
+	} else if err := store.replayWAL(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
 }
 
 // Close will release all resources maintained by store.
 func (store *Store) Close() {
-	store.kvRfd.Close()
-	store.kvRfd = nil
+	if store.WStore == nil { // already closed
+		return
+	}
 	store.idxRfd.Close()
 	store.idxRfd = nil
 	store.WStore.CloseWStore()
@@ -76,8 +100,6 @@ func (store *Store) Close() {
 // Destroy is opposite of Create, it cleans up the datafiles. Data files will
 // be deleted only when all references to WStore is removed.
 func (store *Store) Destroy() {
-	store.kvRfd.Close()
-	store.kvRfd = nil
 	store.idxRfd.Close()
 	store.idxRfd = nil
 	// Close and destroy
@@ -98,6 +120,14 @@ func (store *Store) OpStart(transaction bool) (Node, *MV, int64) {
 	if transaction {
 		store.WStore.translock <- true
 		ts, rootfpos = store.WStore.access(transaction)
+		defer func() {
+			if r := recover(); r != nil { // release the transaction and re-panic
+				store.WStore.release(ts)
+				<-store.WStore.translock
+				panic(r)
+			}
+		}()
+		store.WStore.freelist.popped = store.WStore.freelist.popped[:0]
 		mvroot := mvRoot(store)
 		if mvroot == 0 {
 			mvroot = rootfpos
@@ -111,6 +141,12 @@ func (store *Store) OpStart(transaction bool) (Node, *MV, int64) {
 		mv.commits[root.getLeafNode().fpos] = root
 	} else {
 		ts, rootfpos = store.WStore.access(transaction)
+		defer func() {
+			if r := recover(); r != nil { // release the access and re-panic
+				store.WStore.release(ts)
+				panic(r)
+			}
+		}()
 		if store.Debug {
 			log.Println("Root: ", rootfpos)
 		}
@@ -151,7 +187,20 @@ func (store *Store) OpStartDirty(transaction bool) (Node, *MV, int64) {
 func (store *Store) OpEnd(transaction bool, mv *MV, ts int64) {
 	minAccess := store.WStore.release(ts)
 	if transaction {
+		defer func() { <-store.WStore.translock }()
 		store.WStore.commit(mv, minAccess, false)
+	}
+}
+
+// Abort a transaction that failed midway, opposite of OpStart() API. Nodes
+// copied by the transaction are discarded and their blocks are returned back
+// to the freelist.
+func (store *Store) OpAbort(transaction bool, mv *MV, ts int64) {
+	store.WStore.release(ts)
+	if transaction {
+		freelist := store.WStore.freelist
+		freelist.add(freelist.popped)
+		freelist.popped = freelist.popped[:0]
 		<-store.WStore.translock
 	}
 }
@@ -164,7 +213,7 @@ func (store *Store) FetchNCache(fpos int64) Node {
 	// Sanity check
 	fpos_firstblock, blocksize := store.WStore.fpos_firstblock, store.Blocksize
 	if fpos < fpos_firstblock || (fpos-fpos_firstblock)%blocksize != 0 {
-		panic("Invalid fpos to fetch")
+		panic(fmt.Errorf("%w: invalid fpos %v to fetch", ErrCorrupt, fpos))
 	}
 	// Try to fetch from cache
 	if store.Debug {
@@ -191,7 +240,7 @@ func (store *Store) FetchMVCache(fpos int64) Node {
 	// Sanity check
 	fpos_firstblock, blocksize := store.WStore.fpos_firstblock, store.Blocksize
 	if fpos < fpos_firstblock || (fpos-fpos_firstblock)%blocksize != 0 {
-		log.Panicln("Invalid fpos to fetch", fpos)
+		panic(fmt.Errorf("%w: invalid fpos %v to fetch", ErrCorrupt, fpos))
 	}
 	// Try to fetch from commitQ
 	if node = store.WStore.ccacheLookup(fpos); node == nil {
@@ -208,19 +257,37 @@ func (store *Store) FetchMVCache(fpos int64) Node {
 }
 
 // FetchNode Fetch the prestine block from disk and make a lnode or inode out of it.
+// Blocks that fail to decode or checksum panic with ErrCorrupt, naming fpos.
 func (store *Store) FetchNode(fpos int64) Node {
 	var node Node
 	data := make([]byte, store.Blocksize)
-	if _, err := store.idxRfd.ReadAt(data, fpos); err != nil {
-		panic(err.Error())
+	if _, err := store.idxRfd.ReadAt(data, fpos); err == io.EOF {
+		panic(fmt.Errorf("%w: block at fpos %v beyond index file", ErrCorrupt, fpos))
+	} else if err != nil {
+		panic(err)
+	}
+	b, format := &block{}, store.WStore.head.format
+	if format == BLOCK_GOB {
+		b = b.newBlock(0, store.maxKeys())
+	}
+	if err := b.decode(format, data); err != nil {
+		panic(fmt.Errorf("%w: block at fpos %v, %v", ErrCorrupt, fpos, err))
 	}
-	b := (&block{}).newBlock(0, store.maxKeys())
-	b.gobDecode(data)
 	kn := lnode{block: *b, fpos: fpos}
 	if b.isLeaf() {
 		node = &kn
 	} else {
-		node = &inode{lnode: kn}
+		in := &inode{lnode: kn}
+		// index files created before entry counts were persisted, counts
+		// are marked as not known and computed only on demand, refer
+		// inode.countOf().
+		if len(in.cs) != len(in.vs) {
+			in.cs = in.cs[:0]
+			for range in.vs {
+				in.cs = append(in.cs, -1)
+			}
+		}
+		node = in
 	}
 	return node
 }
@@ -231,8 +298,11 @@ func (store *Store) maxKeys() int {
 	return int(store.WStore.head.maxkeys)
 }
 
+// Maximum number of keys for BLOCK_BINARY format. Intermediate blocks are
+// the largest, with `size+1` values and counts.
 func calculateMaxKeys(blocksize int64) int64 {
-	return (blocksize - 16) / 24
+	max := (blocksize - BLK_HEADER_SIZE - 16) / 32
+	return max - (max % 2) // fix max as even value.
 }
 
 func calculateMaxKeys_gob(blocksize int64) int64 {
@@ -264,31 +334,24 @@ func calculateMaxKeys_gob(blocksize int64) int64 {
 }
 
 //---- local functions
-func openWfd(file string, flag int, perm os.FileMode) *os.File {
-	if wfd, err := os.OpenFile(file, flag, perm); err != nil {
-		panic(err.Error())
-	} else {
-		return wfd
-	}
+func openWfd(file string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(file, flag, perm)
 }
 
-func openRfd(file string) *os.File {
-	if rfd, err := os.Open(file); err != nil {
-		panic(err.Error())
-	} else {
-		return rfd
-	}
+func openRfd(file string) (*os.File, error) {
+	return os.Open(file)
 }
 
+// Check whether configuration matches with the head of index-file.
 func is_configSane(store *Store) bool {
 	wstore := store.WStore
-	if store.Sectorsize != wstore.Sectorsize {
+	if wstore.Sectorsize != wstore.head.sectorsize {
 		return false
 	}
-	if store.Flistsize != wstore.Flistsize {
+	if wstore.Flistsize != wstore.head.flistsize {
 		return false
 	}
-	if store.Blocksize != wstore.Blocksize {
+	if wstore.Blocksize != wstore.head.blocksize {
 		return false
 	}
 	return true
@@ -61,7 +61,7 @@ func (tk *TestKey) CompareLess(s *Store, kfp, dfp int64, isD bool) (int, int64,
 	otherk = s.fetchKey(kfp)
 	// Compare
 	if cmp = bytes.Compare(tk.Bytes(), otherk); cmp == 0 && isD {
-		otherd = s.fetchKey(dfp)
+		otherd = s.fetchDocid(dfp)
 		cmp = bytes.Compare(tk.Docid(), otherd)
 		if cmp == 0 {
 			return cmp, kfp, dfp
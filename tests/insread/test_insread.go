@@ -171,7 +171,7 @@ func lookup(bt *btree.BTree, count, factor int, keys []*btree.TestKey,
 		if dirty {
 			ch = bt.LookupDirty(keys[i])
 		} else {
-			ch = bt.Lookup(keys[i])
+			ch, _ = bt.Lookup(keys[i])
 		}
 		vals := make([]string, 0)
 		for {
@@ -145,7 +145,7 @@ func dolookup(
 		values = append(values[:len(values)/4], cmd[1].([]*btree.TestValue)...)
 		for i := range keys {
 			k, v := keys[i], values[i]
-			ch := bt.Lookup(k)
+			ch, _ := bt.Lookup(k)
 			count += 1
 			found := false
 			vals := make([]string, 0, 100)
@@ -194,7 +194,7 @@ func dolookupNeg(
 		keys, values := cmd[0].([]*btree.TestKey), cmd[1].([]*btree.TestValue)
 		for i := range keys {
 			k := keys[i]
-			ch := bt.Lookup(k)
+			ch, _ := bt.Lookup(k)
 			count += 1
 			vals := make([][]byte, 0, 100)
 			val := <-ch
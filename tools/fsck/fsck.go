@@ -10,11 +10,11 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
+	"github.com/awesomefly/gobtree"
 	"os"
+	"time"
 )
 
 var _ = fmt.Sprintf("keep 'fmt' import during debugging")
@@ -22,49 +22,50 @@ var _ = fmt.Sprintf("keep 'fmt' import during debugging")
 func main() {
 	flag.Parse()
 	args := flag.Args()
-	rfd, _ := os.Open(args[0])
-
-	rfd.Seek(0, os.SEEK_SET)
-	root, sectorsize, flistsize, blocksize, maxkeys, pick, crc := readHead(rfd)
-	fmt.Printf("Root       : %v\n", root)
-	fmt.Printf("Sectorsize : %v\n", sectorsize)
-	fmt.Printf("Flistsize  : %v\n", flistsize)
-	fmt.Printf("Blocksize  : %v\n", blocksize)
-	fmt.Printf("Blocksize  : %v\n", maxkeys)
-	fmt.Printf("Pick       : %v\n", pick)
-	fmt.Printf("CRC        : %v\n", crc)
-
-	rfd.Seek(sectorsize*2, os.SEEK_SET)
-	offsets := freefpos(rfd, flistsize)
-	fmt.Println(len(offsets), offsets)
-}
+	if len(args) < 1 {
+		fmt.Println("usage: fsck <index-file>")
+		os.Exit(2)
+	}
+	heads, pick, err := btree.ReadHeads(args[0])
+	for slot, hd := range heads {
+		if hd == (btree.HeadInfo{}) { // not read
+			continue
+		}
+		fmt.Printf("Head %v, valid: %v\n", slot, hd.Valid)
+		printHead(hd)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-func readHead(rfd *os.File) (int64, int64, int64, int64, int64, int64, uint32) {
-	var root, sectorsize, flistsize, blocksize, maxkeys, pick int64
-	var crc uint32
-	LittleEndian := binary.LittleEndian
-	binary.Read(rfd, LittleEndian, &root)
-	binary.Read(rfd, LittleEndian, &sectorsize)
-	binary.Read(rfd, LittleEndian, &flistsize)
-	binary.Read(rfd, LittleEndian, &blocksize)
-	binary.Read(rfd, LittleEndian, &maxkeys)
-	binary.Read(rfd, LittleEndian, &pick)
-	binary.Read(rfd, LittleEndian, &crc)
-	return root, sectorsize, flistsize, blocksize, maxkeys, pick, crc
+	fl, err := btree.ReadFreelist(args[0], heads[pick], pick)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Freelist %v, valid: %v\n", pick, fl.Valid)
+	fmt.Printf("  Offsets    : %v %v\n", len(fl.Offsets), fl.Offsets)
+	fmt.Printf("  Chain      : %v %v\n", len(fl.Chain), fl.Chain)
 }
 
-func freefpos(rfd *os.File, flistsize int64) []int64 {
-	var fpos int64
-	bytebuf := make([]byte, flistsize)
-	rfd.Read(bytebuf)
-	// Load the offsets
-	offsets := make([]int64, 0)
-	buf := bytes.NewBuffer(bytebuf)
-	binary.Read(buf, binary.LittleEndian, &fpos)
-	for fpos != 0 {
-		offsets = append(offsets, int64(fpos)) // include zero-terminator
-		binary.Read(buf, binary.LittleEndian, &fpos)
+func printHead(hd btree.HeadInfo) {
+	created := "unknown"
+	if hd.Created != 0 {
+		created = time.Unix(0, hd.Created).String()
 	}
-	offsets = append(offsets, int64(fpos)) // include zero-terminator
-	return offsets
+	fmt.Printf("  Magic      : %x\n", hd.Magic)
+	fmt.Printf("  Version    : %v.%v\n", hd.Major, hd.Minor)
+	fmt.Printf("  Created    : %v\n", created)
+	fmt.Printf("  Root       : %v\n", hd.Root)
+	fmt.Printf("  Timestamp  : %v\n", hd.Timestamp)
+	fmt.Printf("  Sectorsize : %v\n", hd.Sectorsize)
+	fmt.Printf("  Flistsize  : %v\n", hd.Flistsize)
+	fmt.Printf("  Blocksize  : %v\n", hd.Blocksize)
+	fmt.Printf("  Maxkeys    : %v\n", hd.Maxkeys)
+	fmt.Printf("  Pick       : %v\n", hd.Pick)
+	fmt.Printf("  CRC        : %v\n", hd.CRC)
+	fmt.Printf("  Format     : %v\n", hd.Format)
+	fmt.Printf("  KVformat   : %v\n", hd.KVformat)
+	fmt.Printf("  KVbase     : %v\n", hd.KVbase)
 }
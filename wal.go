@@ -0,0 +1,228 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Write-ahead log for index mutations. Snapshots are flushed to index-file
+// in batches, refer DrainRate, and mutations that are not yet flushed are
+// lost on a crash. When `Walfile` is configured, every Insert and Remove is
+// appended to the log before the transaction returns, with the
+// transaction's timestamp as its sequence number. Each record is laid out
+// as,
+//
+//	| size uint32 | crc uint32 | seqno int64 | op byte | klen uint32 | dlen uint32 |
+//	| key [klen]byte | docid [dlen]byte | value []byte |
+//
+// where `size` counts the bytes following `crc`, and `crc` is CRC32 over
+// them. Log is truncated once a flushed head covers all of its records.
+//
+// When the index is opened, records whose sequence number is newer than the
+// head's timestamp are replayed as a single transaction, using
+// Config.WALKey to construct the keys, and the replayed snapshot is flushed
+// before the index is made available.
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+)
+
+// Operations logged in write-ahead log.
+const (
+	WAL_UPSERT    byte = iota + 1 // insert or replace {key,docid,value}
+	WAL_REMOVE                    // remove {key,docid}
+	WAL_REMOVEALL                 // remove all entries for key
+)
+
+const WAL_HEADER_SIZE = 8 + 8 + 1 + 4 + 4 // excluding size and crc.
+
+// Record read back from write-ahead log.
+type walRecord struct {
+	seqno      int64
+	op         byte
+	key, docid []byte
+	value      []byte
+}
+
+// Value replayed from write-ahead log.
+type walValue []byte
+
+func (v walValue) Bytes() []byte {
+	return []byte(v)
+}
+
+// Open write-ahead log and load records that are not covered by the head.
+// Called once the head is fetched.
+func (wstore *WStore) openWAL() error {
+	if wstore.Walfile == "" {
+		return nil
+	}
+	walWfd, err := openWfd(wstore.Walfile, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(walWfd)
+	if err != nil {
+		walWfd.Close()
+		return err
+	}
+	recs, size := decodeWAL(data)
+	// discard torn record, if any, at the end of the log.
+	if err := walWfd.Truncate(size); err != nil {
+		walWfd.Close()
+		return err
+	}
+	wstore.walWfd, wstore.walsize = walWfd, size
+	for _, rec := range recs {
+		if rec.seqno > wstore.head.timestamp {
+			wstore.walrecs = append(wstore.walrecs, rec)
+			wstore.walseq = rec.seqno
+		}
+	}
+	return nil
+}
+
+// Log a mutation under transaction `mv`, records are written to the log by
+// flushWAL() before the transaction ends.
+func (wstore *WStore) logWAL(mv *MV, op byte, key Key, v Value) {
+	if wstore.walWfd == nil {
+		return
+	}
+	var docid, value []byte
+	if op != WAL_REMOVEALL {
+		docid = key.Docid()
+	}
+	if v != nil {
+		value = v.Bytes()
+	}
+	mv.wal = append(mv.wal, walRecord{mv.timestamp, op, key.Bytes(), docid, value})
+}
+
+// Append records logged by transaction `mv` and sync them to disk.
+func (wstore *WStore) flushWAL(mv *MV) {
+	if wstore.walWfd == nil || len(mv.wal) == 0 {
+		return
+	}
+	data := make([]byte, 0)
+	for _, rec := range mv.wal {
+		data = rec.encode(data)
+	}
+	if _, err := wstore.walWfd.WriteAt(data, wstore.walsize); err != nil {
+		panic(err)
+	} else if err := wstore.walWfd.Sync(); err != nil {
+		panic(err)
+	}
+	wstore.walsize += int64(len(data))
+	wstore.walseq = mv.timestamp
+}
+
+// Truncate the log once the head, flushed with timestamp `mvts`, covers all
+// of its records. Records that are not yet replayed are never truncated.
+func (wstore *WStore) truncateWAL(mvts int64) {
+	if wstore.walWfd == nil || wstore.walsize == 0 || wstore.walseq > mvts {
+		return
+	} else if len(wstore.walrecs) > 0 {
+		return
+	}
+	if err := wstore.walWfd.Truncate(0); err != nil {
+		panic(err)
+	}
+	wstore.walsize = 0
+}
+
+// Replay records loaded by openWAL() as a single transaction and flush the
+// replayed snapshot.
+func (store *Store) replayWAL() error {
+	wstore := store.WStore
+	recs := wstore.walrecs
+	if len(recs) == 0 {
+		return nil
+	} else if wstore.WALKey == nil {
+		return fmt.Errorf("btree: WALKey is required to replay %v", wstore.Walfile)
+	}
+	bt := NewBTree(store)
+	err := bt.transaction(func(root Node, mv *MV) Node {
+		for _, rec := range recs {
+			key := wstore.WALKey(rec.key, rec.docid)
+			switch rec.op {
+			case WAL_UPSERT:
+				root, _ = bt.insertRoot(root, key, walValue(rec.value), INSERT_UPSERT, mv)
+			case WAL_REMOVE:
+				if root.getLeafNode().size > 0 {
+					root, _, _, _, _ = root.remove(store, key, mv)
+				}
+			case WAL_REMOVEALL:
+				root, _ = bt.removeAll(root, key, mv)
+			default:
+				panic(fmt.Errorf("%w: invalid op %v in %v", ErrCorrupt, rec.op, wstore.Walfile))
+			}
+		}
+		return root
+	})
+	if err != nil {
+		return err
+	}
+	wstore.walrecs = nil
+	bt.Drain()
+	return nil
+}
+
+// Append encoded record to `data`.
+func (rec *walRecord) encode(data []byte) []byte {
+	size := WAL_HEADER_SIZE + len(rec.key) + len(rec.docid) + len(rec.value)
+	buf := make([]byte, 8+size)
+	LittleEndian := binary.LittleEndian
+	LittleEndian.PutUint32(buf[0:], uint32(size))
+	LittleEndian.PutUint64(buf[8:], uint64(rec.seqno))
+	buf[16] = rec.op
+	LittleEndian.PutUint32(buf[17:], uint32(len(rec.key)))
+	LittleEndian.PutUint32(buf[21:], uint32(len(rec.docid)))
+	n := 8 + WAL_HEADER_SIZE
+	n += copy(buf[n:], rec.key)
+	n += copy(buf[n:], rec.docid)
+	copy(buf[n:], rec.value)
+	LittleEndian.PutUint32(buf[4:], crc32.Checksum(buf[8:], crctab))
+	return append(data, buf...)
+}
+
+// Decode records from `data`, stop at the first torn or corrupt record.
+// Return the records and the size of log upto the last valid record.
+func decodeWAL(data []byte) ([]walRecord, int64) {
+	LittleEndian := binary.LittleEndian
+	recs, off := make([]walRecord, 0), 0
+	for len(data)-off >= 8+WAL_HEADER_SIZE {
+		buf := data[off:]
+		size := int(LittleEndian.Uint32(buf[0:]))
+		if size < WAL_HEADER_SIZE || len(buf) < 8+size {
+			break
+		}
+		buf = buf[:8+size]
+		if LittleEndian.Uint32(buf[4:]) != crc32.Checksum(buf[8:], crctab) {
+			break
+		}
+		klen, dlen := int(LittleEndian.Uint32(buf[17:])), int(LittleEndian.Uint32(buf[21:]))
+		if WAL_HEADER_SIZE+klen+dlen > size {
+			break
+		}
+		kd := buf[8+WAL_HEADER_SIZE:]
+		rec := walRecord{
+			seqno: int64(LittleEndian.Uint64(buf[8:])),
+			op:    buf[16],
+			key:   kd[:klen],
+			docid: kd[klen : klen+dlen],
+			value: kd[klen+dlen:],
+		}
+		if dlen == 0 && rec.op == WAL_REMOVEALL {
+			rec.docid = nil
+		}
+		recs, off = append(recs, rec), off+8+size
+	}
+	return recs, int64(off)
+}
@@ -0,0 +1,147 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func walConfig(name string) Config {
+	conf := testconf1
+	conf.Idxfile = "./data/" + name + "_index.dat"
+	conf.Kvfile = "./data/" + name + "_kv.dat"
+	conf.Walfile = "./data/" + name + ".wal"
+	conf.DrainRate = 1000
+	conf.WALKey = func(key, docid []byte) Key {
+		id, _ := strconv.ParseInt(string(docid), 10, 64)
+		return &TestKey{K: string(key), Id: id}
+	}
+	for _, file := range []string{conf.Idxfile, conf.Kvfile, conf.Walfile} {
+		os.Remove(file)
+	}
+	return conf
+}
+
+func Test_WAL(t *testing.T) {
+	conf := walConfig("wal")
+	bt := NewBTree(NewStore(conf))
+	defer func() {
+		bt.store.Destroy()
+	}()
+	for i := 0; i < 200; i++ {
+		bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("value%v", i)})
+	}
+	bt.Drain()
+	if fi, _ := os.Stat(conf.Walfile); fi.Size() != 0 {
+		t.Fatalf("expected log to be truncated after flush, got %v", fi.Size())
+	}
+	// mutations that are only in the log.
+	for i := 200; i < 300; i++ {
+		bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("value%v", i)})
+	}
+	for i := 0; i < 50; i++ {
+		bt.Remove(testKey(i))
+	}
+	bt.Insert(testKey(100), &TestValue{V: "newvalue"})
+	bt.RemoveAll(testKey(60))
+
+	// crash, by copying files of the live index.
+	crashconf := walConfig("walcrash")
+	for _, file := range [][2]string{
+		{conf.Idxfile, crashconf.Idxfile},
+		{conf.Kvfile, crashconf.Kvfile},
+		{conf.Walfile, crashconf.Walfile},
+	} {
+		data, err := ioutil.ReadFile(file[0])
+		if err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(file[1], data, 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crashbt := NewBTree(NewStore(crashconf))
+	defer func() {
+		crashbt.store.Destroy()
+	}()
+	if c := crashbt.Count(); c != 249 {
+		t.Fatalf("expected %v entries, got %v", 249, c)
+	}
+	for i := 0; i < 300; i++ {
+		v, ok, _ := crashbt.Get(testKey(i))
+		if i < 50 || i == 60 {
+			if ok {
+				t.Fatalf("expected key%05d to be removed", i)
+			}
+		} else if i == 100 {
+			if string(v) != "newvalue" {
+				t.Fatalf("expected newvalue, got %v", string(v))
+			}
+		} else if string(v) != fmt.Sprintf("value%v", i) {
+			t.Fatalf("expected value%v, got %v", i, string(v))
+		}
+	}
+	crashbt.Check()
+	if fi, _ := os.Stat(crashconf.Walfile); fi.Size() != 0 {
+		t.Fatalf("expected log to be truncated after replay, got %v", fi.Size())
+	}
+}
+
+func Test_WALReplayFailure(t *testing.T) {
+	conf := walConfig("walfail")
+	bt := NewBTree(NewStore(conf))
+	for i := 0; i < 100; i++ {
+		bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("value%v", i)})
+	}
+	bt.Drain()
+	// mutations that are only in the log.
+	for i := 100; i < 150; i++ {
+		bt.Insert(testKey(i), &TestValue{V: fmt.Sprintf("value%v", i)})
+	}
+
+	// crash, by copying files of the live index.
+	crashconf := walConfig("walfailcrash")
+	for _, file := range [][2]string{
+		{conf.Idxfile, crashconf.Idxfile},
+		{conf.Kvfile, crashconf.Kvfile},
+		{conf.Walfile, crashconf.Walfile},
+	} {
+		data, err := ioutil.ReadFile(file[0])
+		if err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(file[1], data, 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.store.Destroy()
+	fi, _ := os.Stat(crashconf.Walfile)
+	walsize := fi.Size()
+
+	// replay fails without WALKey, log is left as is.
+	walkey := crashconf.WALKey
+	crashconf.WALKey = nil
+	if _, err := OpenStore(crashconf); err == nil {
+		t.Fatalf("expected replay to fail without WALKey")
+	} else if fi, _ := os.Stat(crashconf.Walfile); fi.Size() != walsize {
+		t.Fatalf("expected log of %v bytes, got %v", walsize, fi.Size())
+	}
+	crashconf.WALKey = walkey
+	crashbt := NewBTree(NewStore(crashconf))
+	defer func() {
+		crashbt.store.Destroy()
+	}()
+	if c := crashbt.Count(); c != 150 {
+		t.Fatalf("expected %v entries, got %v", 150, c)
+	}
+	crashbt.Check()
+}
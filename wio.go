@@ -87,16 +87,29 @@ func (wstore *WStore) flushSnapshot(
 	//    WStore.flushNode(node)
 	//}
 
-	// Cloned freelist
-	freelist := wstore.freelist.clone()
-	freelist.add(offsets)
-	crc := freelist.flush() // then this
+	// Freelist, along with recycled blocks
+	wstore.freelist.add(offsets)
+	wstore.flushHead(mvroot, mvts)
+	wstore.truncateWAL(mvts)
+	if wstore.kvpending != "" { // head now refers to compacted kv-file.
+		wstore.renameKV()
+	}
+	if wstore.Debug {
+		log.Println("snapshot", mvroot, mvts, commitQ, offsets)
+	}
+}
+
+// Flush freelist and head, referring to `mvroot`, as the next generation.
+func (wstore *WStore) flushHead(mvroot, mvts int64) {
+	freelist := wstore.freelist
+	crc := freelist.flush(wstore.head.nextSlot()) // then this
+	// head shall not refer to nodes and freelist that are not yet on disk.
+	wstore.idxWfd.Sync()
 	// Cloned head
 	head := wstore.head.clone()
 	head.setRoot(mvroot, mvts)
 	head.flush(crc) // finally this
 	wstore.idxWfd.Sync()
-	if wstore.Debug {
-		log.Println("snapshot", mvroot, mvts, commitQ, offsets)
-	}
+	wstore.head.pick = head.pick
+	freelist.release() // previous overflow blocks are free now.
 }
@@ -11,11 +11,14 @@
 package btree
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -30,6 +33,8 @@ type MV struct {
 	root      int64
 	commits   map[int64]Node
 	stales    []int64
+	kvretire  *kvGen      // kv-file generation retired along with stales.
+	wal       []walRecord // mutations to log before the transaction ends.
 }
 
 // structure that handles write.
@@ -38,15 +43,22 @@ type WStore struct {
 	// More than one *Store can refer to a single instance of *WStore. Don't
 	// close *WStore until refcount becomes Zero.
 	refcount        int
-	idxWfd          *os.File  // index-file opened in write-only mode.
-	kvWfd           *os.File  // file descriptor opened in append-only mode.
-	head            *Head     // head of the index store.
-	freelist        *FreeList // list of free blocks.
-	fpos_firstblock int64     // file offset for btree block.
-	MVCC                      // MVCC concurrency control go-routine
-	IO                        // IO flusher
-	DEFER                     // kv-cache
-	pingPong                  // ping-pong cache
+	idxWfd          *os.File       // index-file opened in write-only mode.
+	kvWfd           *os.File       // file descriptor opened in append-only mode.
+	kvgen           unsafe.Pointer // *kvGen, latest kv-file generation.
+	kvpending       string         // compacted kv-file yet to be renamed.
+	walWfd          *os.File       // write-ahead log, nil if not configured.
+	walsize         int64          // size of write-ahead log.
+	walseq          int64          // sequence number of last logged record.
+	walrecs         []walRecord    // records to replay when store is opened.
+	rebuild         bool           // freelist to be rebuilt when store is opened.
+	head            *Head          // head of the index store.
+	freelist        *FreeList      // list of free blocks.
+	fpos_firstblock int64          // file offset for btree block.
+	MVCC                           // MVCC concurrency control go-routine
+	IO                             // IO flusher
+	DEFER                          // kv-cache
+	pingPong                       // ping-pong cache
 	WStoreStats
 }
 
@@ -55,6 +67,7 @@ type WStoreStats struct {
 	// Cache hits
 	ncHits     int64
 	lcHits     int64
+	lcMisses   int64
 	keyHits    int64
 	docidHits  int64
 	commitHits int64
@@ -75,7 +88,6 @@ type WStoreStats struct {
 	countMergeRight  int64
 	countRotateLeft  int64
 	countRotateRight int64
-	garbageBlocks    int64
 	dumpCounts       int64
 	loadCounts       int64
 	MVloadCounts     int64
@@ -86,30 +98,22 @@ type WStoreStats struct {
 // Main API to get or instantiate a write-store. If write-store for this index
 // file is already created, it will bre returned after incrementing the
 // reference count.
-func OpenWStore(conf Config) *WStore {
-	var wstore *WStore
-	defer func() {
-		res := make(chan []interface{})
-		wstore.req <- []interface{}{WS_SAYHI, res} // Say hi
-		<-res
-	}()
-	wstore = getWStore(conf) // Try getting a write-store
-	if wstore == nil {       // nil means we have to create a new index file
-		idxfile, _ := filepath.Abs(conf.Idxfile)
-		// If index file is not even created, then create a new index file.
-		createWStore(conf)
-		// Open a new instance of index file in write-mode.
-		wstore = newWStore(conf)
-		wstore.head = newHead(wstore)
-		wstore.head.maxkeys = calculateMaxKeys_gob(wstore.Blocksize)
-		wstore.freelist = newFreeList(wstore)
-		wstore.head.fetch()
-		wstore.freelist.fetch(wstore.head.crc)
-		writeStores[idxfile] = wstore
-		go doMVCC(wstore)
-		go doDefer(wstore)
+func OpenWStore(conf Config) (*WStore, error) {
+	wstore, err := getWStore(conf) // Try getting a write-store
+	if err == nil && wstore == nil {
+		// nil means we have to create a new index file, then open a new
+		// instance of index file in write-mode.
+		if err = createWStore(conf); err == nil {
+			wstore, err = getWStore(conf)
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
-	return wstore
+	res := make(chan []interface{})
+	wstore.req <- []interface{}{WS_SAYHI, res} // Say hi
+	<-res
+	return wstore, nil
 }
 
 // Close write-Store
@@ -118,13 +122,12 @@ func (wstore *WStore) CloseWStore() bool {
 		if wstore.Debug {
 			log.Println("Closing WStore:", wstore.Idxfile)
 		}
-		wstore.commit(nil, 0, true)
+		if wstore.rebuild == false { // don't persist freelist that failed to validate.
+			wstore.commit(nil, 0, true)
+		}
 		wstore.closeChannels()
 		// Cleanup
-		wstore.kvWfd.Close()
-		wstore.kvWfd = nil
-		wstore.idxWfd.Close()
-		wstore.idxWfd = nil
+		wstore.closeFiles()
 		wstore.judgementDay()
 		close(wstore.translock)
 		wstore.translock = nil
@@ -141,56 +144,93 @@ func (wstore *WStore) DestroyWStore() {
 	if _, err := os.Stat(wstore.Kvfile); err == nil {
 		os.Remove(wstore.Kvfile)
 	}
+	files, _ := kvCompactFiles(wstore.Kvfile)
+	for file := range files {
+		os.Remove(file)
+	}
+	if wstore.Walfile != "" {
+		os.Remove(wstore.Walfile)
+	}
 }
 
 // Use `wmu` exclusion lock to fetch an existing write-store. By existing we
 // refer an already instantiated write-store for this index file, or a new
 // instance of the write-store if index file is present. If index file is
 // not-found return nil.
-func getWStore(conf Config) *WStore {
-	var wstore *WStore
-	idxfile, _ := filepath.Abs(conf.Idxfile)
+func getWStore(conf Config) (wstore *WStore, err error) {
+	idxfile, err := filepath.Abs(conf.Idxfile)
+	if err != nil {
+		return nil, err
+	}
 	wmu.Lock() // Protected access
 	defer wmu.Unlock()
 
 	wstore = writeStores[idxfile]
 	if wstore != nil {
 		// If already index file is opened, return the same reference.
+		if _, err = mergeIndexConfig(conf.IndexConfig, wstore.IndexConfig); err != nil {
+			return nil, err
+		}
 		wstore.refcount += 1 // increment the reference count.
-	} else if _, err := os.Stat(idxfile); err == nil {
+	} else if _, err = os.Stat(idxfile); err == nil {
+		// Index configuration is persisted in head sector.
+		var disk IndexConfig
+		if disk, err = readIndexConfig(conf); err != nil {
+			return nil, err
+		} else if conf.IndexConfig, err = mergeIndexConfig(conf.IndexConfig, disk); err != nil {
+			return nil, err
+		}
 		// Open the new Store.
-		wstore = newWStore(conf)
+		if wstore, err = newWStore(conf); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				wstore.closeFiles()
+				wstore, err = nil, recoverError(r)
+			}
+		}()
 		wstore.head = newHead(wstore)
 		wstore.freelist = newFreeList(wstore)
-		wstore.head.fetch()
-		wstore.freelist.fetch(wstore.head.crc)
-		// FIXME : following call is not required since maxkeys should be
-		// present in indexfile.
-		wstore.head.maxkeys = calculateMaxKeys_gob(wstore.Blocksize)
+		headok := wstore.head.fetch()
+		flok := wstore.freelist.fetch(wstore.head.slot(), wstore.head.crc)
+		wstore.rebuild = headok == false || flok == false
+		wstore.upgrade()
+		if err := wstore.recoverKV(); err != nil {
+			panic(err)
+		} else if err := wstore.openKV(); err != nil {
+			panic(err)
+		} else if err := wstore.openWAL(); err != nil {
+			panic(err)
+		}
+		wstore.head.maxkeys = wstore.checkMaxKeys(wstore.head.maxkeys)
 		writeStores[idxfile] = wstore
 		go doMVCC(wstore)
 		go doDefer(wstore)
+	} else if os.IsNotExist(err) {
+		return nil, nil
 	}
-	return wstore
+	return wstore, err
 }
 
-// New instance of WStore.
-func newWStore(conf Config) *WStore {
-	idxmode, kvmode := os.O_WRONLY, os.O_WRONLY
+// New instance of WStore, kv-file is opened separately by openKV().
+func newWStore(conf Config) (*WStore, error) {
+	idxmode := os.O_WRONLY
 	// open in durability mode.
 	if conf.Sync {
 		idxmode |= os.O_SYNC
-		kvmode |= os.O_SYNC
 	}
 	if conf.Nocache {
 		idxmode |= syscall.F_NOCACHE
-		kvmode |= syscall.F_NOCACHE
+	}
+	idxWfd, err := openWfd(conf.Idxfile, idxmode, 0660)
+	if err != nil {
+		return nil, err
 	}
 	wstore := &WStore{
 		Config:          conf,
 		refcount:        1,
-		idxWfd:          openWfd(conf.Idxfile, idxmode, 0660),
-		kvWfd:           openWfd(conf.Kvfile, kvmode, 0660),
+		idxWfd:          idxWfd,
 		fpos_firstblock: conf.Sectorsize*2 + conf.Flistsize*2,
 		MVCC: MVCC{
 			accessQ:   make([]int64, 0),
@@ -199,9 +239,9 @@ func newWStore(conf Config) *WStore {
 		},
 		pingPong: pingPong{
 			ncping: unsafe.Pointer(newNodeCache()),
-			lcping: unsafe.Pointer(newNodeCache()),
+			lcping: unsafe.Pointer(newLeafCache(conf.MaxLeafCache)),
 			ncpong: unsafe.Pointer(newNodeCache()),
-			lcpong: unsafe.Pointer(newNodeCache()),
+			lcpong: unsafe.Pointer(newLeafCache(conf.MaxLeafCache)),
 			kdping: unsafe.Pointer(newKDCache()),
 			kdpong: unsafe.Pointer(newKDCache()),
 		},
@@ -217,7 +257,55 @@ func newWStore(conf Config) *WStore {
 	if wstore.MVCCThrottleRate == 0 {
 		wstore.MVCCThrottleRate = 100 // milliseconds
 	}
-	return wstore
+	return wstore, nil
+}
+
+// Close index-file and kv-file opened by newWStore() and openKV().
+func (wstore *WStore) closeFiles() {
+	if wstore.kvWfd != nil {
+		wstore.kvWfd.Close()
+		wstore.kvWfd = nil
+	}
+	gen := (*kvGen)(atomic.LoadPointer(&wstore.kvgen))
+	for ; gen != nil; gen = gen.prev {
+		gen.rfd.Close()
+	}
+	atomic.StorePointer(&wstore.kvgen, nil)
+	if wstore.walWfd != nil {
+		wstore.walWfd.Close()
+		wstore.walWfd = nil
+	}
+	wstore.idxWfd.Close()
+	wstore.idxWfd = nil
+}
+
+// Open kv-file for append and read. Called once the head is fetched.
+func (wstore *WStore) openKV() error {
+	kvWfd, err := openWfd(wstore.Kvfile, wstore.kvmode(), 0660)
+	if err != nil {
+		return err
+	}
+	kvRfd, err := openRfd(wstore.Kvfile)
+	if err != nil {
+		kvWfd.Close()
+		return err
+	}
+	wstore.kvWfd = kvWfd
+	gen := &kvGen{base: wstore.head.kvbase, rfd: kvRfd}
+	atomic.StorePointer(&wstore.kvgen, unsafe.Pointer(gen))
+	return nil
+}
+
+// Flags to open kv-file in write-only mode.
+func (wstore *WStore) kvmode() int {
+	kvmode := os.O_WRONLY
+	if wstore.Sync {
+		kvmode |= os.O_SYNC
+	}
+	if wstore.Nocache {
+		kvmode |= syscall.F_NOCACHE
+	}
+	return kvmode
 }
 
 // Lock and dereference the WStore before closing it.
@@ -236,26 +324,70 @@ func derefWSTore(wstore *WStore) bool {
 }
 
 // Create a new data-store for btree indexing.
-func createWStore(conf Config) {
+func createWStore(conf Config) (err error) {
+	// Default values for index configuration
+	if conf.Sectorsize == 0 {
+		conf.Sectorsize = SECTOR_SIZE
+	}
+	if conf.Flistsize == 0 {
+		conf.Flistsize = FLIST_SIZE
+	}
+	if conf.Blocksize == 0 {
+		conf.Blocksize = BLOCK_SIZE
+	}
 	// Create index file and associated key-value file.
-	os.Create(conf.Idxfile)
-	os.Create(conf.Kvfile)
+	if conf.Walfile != "" { // log, if any, belongs to an older index.
+		os.Remove(conf.Walfile)
+	}
+	for _, file := range []string{conf.Idxfile, conf.Kvfile} {
+		if fd, err := os.Create(file); err != nil {
+			return err
+		} else {
+			fd.Close()
+		}
+	}
 	// Index store
-	wfd := openWfd(conf.Idxfile, os.O_RDWR, 0660)
-	// Append head sectors
+	wfd, err := openWfd(conf.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	// Append head sectors and freelist blocks.
 	hdblock := make([]byte, conf.Sectorsize)
-	wfd.Write(hdblock)
-	wfd.Write(hdblock)
-	// Append freelist block
 	flblock := make([]byte, conf.Flistsize)
-	wfd.Write(flblock)
-	wfd.Write(flblock)
-	wfd.Close()
+	for _, data := range [][]byte{hdblock, hdblock, flblock, flblock} {
+		if _, err = wfd.Write(data); err != nil {
+			wfd.Close()
+			return err
+		}
+	}
+	if err = wfd.Close(); err != nil {
+		return err
+	}
 
 	// Create a head, and freelist
-	wstore := newWStore(conf)
+	wstore, err := newWStore(conf)
+	if err != nil {
+		return err
+	}
+	defer catch(&err)
+	defer func() {
+		wstore.closeFiles()
+		close(wstore.req)
+		wstore.req = nil
+		close(wstore.deferReq)
+		wstore.deferReq = nil
+		close(wstore.translock)
+		wstore.translock = nil
+	}()
 	wstore.head = newHead(wstore)
-	wstore.head.maxkeys = calculateMaxKeys_gob(wstore.Blocksize)
+	wstore.head.magic = HEAD_MAGIC
+	wstore.head.major, wstore.head.minor = INDEX_MAJOR, INDEX_MINOR
+	wstore.head.created = time.Now().UnixNano()
+	wstore.head.format = BLOCK_BINARY
+	if conf.KVChecksum {
+		wstore.head.kvformat = KV_CHECKSUM
+	}
+	wstore.head.maxkeys = calculateMaxKeys(wstore.Blocksize)
 	wstore.freelist = newFreeList(wstore)
 
 	// Setup the head and freelist on disk.
@@ -267,20 +399,10 @@ func createWStore(conf Config) {
 	b := (&block{leaf: TRUE}).newBlock(0, 0)
 	root := &lnode{block: *b, fpos: fpos, dirty: true}
 	wstore.flushNode(root)
-	wstore.head.setRoot(root.fpos, 0)
-	crc := wstore.freelist.flush()
-	wstore.head.flush(crc)
-	// Close WStore
-	wstore.kvWfd.Close()
-	wstore.kvWfd = nil
-	wstore.idxWfd.Close()
-	wstore.idxWfd = nil
-	close(wstore.req)
-	wstore.req = nil
-	close(wstore.deferReq)
-	wstore.deferReq = nil
-	close(wstore.translock)
-	wstore.translock = nil
+	// Both copies of head and freelist are valid from the start.
+	wstore.flushHead(root.fpos, 0)
+	wstore.flushHead(root.fpos, 0)
+	return nil
 }
 
 // appendBlocks will add new free blocks at the end of the index-file. New
@@ -298,11 +420,11 @@ func (wstore *WStore) appendBlocks(fpos int64, count int) []int64 {
 		// Fix where to append
 		if fpos == 0 {
 			if fpos, err = wfd.Seek(0, os.SEEK_END); err != nil {
-				panic(err.Error())
+				panic(err)
 			}
 		} else {
 			if fpos, err = wfd.Seek(fpos, os.SEEK_SET); err != nil {
-				panic(err.Error())
+				panic(err)
 			}
 		}
 		// Actuall append
@@ -311,7 +433,7 @@ func (wstore *WStore) appendBlocks(fpos int64, count int) []int64 {
 				offsets = append(offsets, fpos)
 				fpos += int64(n)
 			} else {
-				panic(err.Error())
+				panic(err)
 			}
 		}
 		wstore.appendCounts += 1 // stats
@@ -322,12 +444,12 @@ func (wstore *WStore) appendBlocks(fpos int64, count int) []int64 {
 func (wstore *WStore) flushNode(node Node) {
 	var data []byte
 	kn := node.getLeafNode()
-	data = kn.gobEncode()
+	data = kn.encode(wstore.head.format)
 	if len(data) <= int(wstore.Blocksize) {
 		wstore.idxWfd.WriteAt(data, kn.fpos)
 		wstore.dumpCounts += 1 // stats
 	} else {
-		panic("flushNode, btree block greater than store.blocksize")
+		panic(fmt.Errorf("flushNode, btree block greater than store.blocksize"))
 	}
 }
 
@@ -346,12 +468,34 @@ func (wstore *WStore) appendCount() int {
 	return count
 }
 
-// Get the maximum number of free blocks that can be monitored by the
-// index-file. Returned value includes zero entry terminating the list.
+// Validate `maxkeys` persisted in head. Index files in BLOCK_GOB format,
+// from older versions, were flushed with zero maxkeys and are opened with
+// maxkeys calculated from blocksize.
+func (wstore *WStore) checkMaxKeys(maxkeys int64) int64 {
+	limit := calculateMaxKeys(wstore.Blocksize)
+	if wstore.head.format == BLOCK_GOB {
+		limit = calculateMaxKeys_gob(wstore.Blocksize)
+		if maxkeys == 0 {
+			return limit
+		}
+	}
+	if maxkeys <= 0 || maxkeys%2 != 0 || maxkeys > limit {
+		panic(fmt.Errorf("%w: invalid maxkeys %v", ErrCorrupt, maxkeys))
+	}
+	return maxkeys
+}
+
+// Get the number of slots in freelist block. Returned value includes the
+// last slot linking overflow blocks.
 func (wstore *WStore) maxFreeBlocks() int {
 	return int(wstore.Flistsize / OFFSET_SIZE)
 }
 
+// Get the number of free blocks that can be listed by an overflow block.
+func (wstore *WStore) overflowSlots() int {
+	return int(wstore.Blocksize-FLBLK_HEADER_SIZE) / OFFSET_SIZE
+}
+
 func (wstore *WStore) judgementDay() {
 	if len(wstore.accessQ) > 0 {
 		panic("still a store access is in-progress")